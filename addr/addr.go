@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 )
 
@@ -56,9 +57,70 @@ func (a Addr) Bytes() []byte {
 		buf.WriteByte(byte(len(a.Domain)))
 		buf.WriteString(a.Domain)
 	default:
+		ip := a.IP.To4()
+		if ip == nil {
+			// zero address 0.0.0.0
+			ip = make(net.IP, net.IPv4len)
+		}
 		buf.WriteByte(byte(IPV4))
-		binary.Write(&buf, binary.BigEndian, a.IP.To4())
+		binary.Write(&buf, binary.BigEndian, ip)
 	}
 	binary.Write(&buf, binary.BigEndian, a.Port)
 	return buf.Bytes()
 }
+
+// FromIP build address by ip and port
+func FromIP(ip net.IP, port uint16) Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Addr{Type: IPV4, IP: ip4, Port: port}
+	}
+	return Addr{Type: IPV6, IP: ip.To16(), Port: port}
+}
+
+// Read read compact address from r
+func Read(r io.Reader) (Addr, error) {
+	var t [1]byte
+	_, err := io.ReadFull(r, t[:])
+	if err != nil {
+		return Addr{Type: Unknown}, err
+	}
+	a := Addr{Type: Type(t[0])}
+	var buf []byte
+	switch a.Type {
+	case IPV4:
+		buf = make([]byte, net.IPv4len+2)
+	case IPV6:
+		buf = make([]byte, net.IPv6len+2)
+	case Domain:
+		var l [1]byte
+		_, err = io.ReadFull(r, l[:])
+		if err != nil {
+			return Addr{Type: Unknown}, err
+		}
+		buf = make([]byte, int(l[0])+2)
+	default:
+		return Addr{Type: Unknown}, fmt.Errorf("unsupported address type: %d", t[0])
+	}
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return Addr{Type: Unknown}, err
+	}
+	if a.Type == Domain {
+		a.Domain = string(buf[:len(buf)-2])
+	} else {
+		a.IP = net.IP(buf[:len(buf)-2])
+	}
+	a.Port = binary.BigEndian.Uint16(buf[len(buf)-2:])
+	return a, nil
+}
+
+// Parse parse compact address at the beginning of data, return the
+// address and its length
+func Parse(data []byte) (Addr, int, error) {
+	r := bytes.NewReader(data)
+	a, err := Read(r)
+	if err != nil {
+		return a, 0, err
+	}
+	return a, len(data) - r.Len(), nil
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// Checker check user/pass, Check can be used as socks5.UserPass.Check
+// and http.ServerConf.CheckUserPass
+type Checker interface {
+	Check(user, pass string) bool
+}
+
+// FromChecker check user/pass with client address, CheckFrom can be used
+// as socks5.UserPass.CheckFrom and http.ServerConf.CheckUserPassFrom
+type FromChecker interface {
+	CheckFrom(from, user, pass string) bool
+}
+
+// CheckFunc adapt function to Checker
+type CheckFunc func(user, pass string) bool
+
+// Check call f
+func (f CheckFunc) Check(user, pass string) bool {
+	return f(user, pass)
+}
+
+// Equal compare a and b in constant time, length of a and b is not leaked
+func Equal(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
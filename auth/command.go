@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command check user/pass by external program, user and pass are written
+// to stdin in two lines, exit code 0 is allowed, user is also set in
+// environment PROXY_USER
+type Command struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration // Default: 5s
+}
+
+// Check run program and check exit code
+func (c Command) Check(user, pass string) bool {
+	if strings.ContainsAny(user, "\r\n") || strings.ContainsAny(pass, "\r\n") {
+		return false
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Env = append(os.Environ(), "PROXY_USER="+user)
+	cmd.Stdin = strings.NewReader(user + "\n" + pass + "\n")
+	return cmd.Run() == nil
+}
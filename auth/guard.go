@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBanned client or user is banned by guard
+var ErrBanned = errors.New("temporarily banned")
+
+// maxGuardRecords stale records are evicted when reached, new user records
+// are not created when still reached after evicted
+const maxGuardRecords = 100000
+
+// GuardConf brute-force protection config
+type GuardConf struct {
+	MaxFailures int           // Default: 5, failures in Window before ban
+	Window      time.Duration // Default: 10m
+	BanTime     time.Duration // Default: 15m
+	BaseDelay   time.Duration // Default: 100ms, doubled by each failure
+	MaxDelay    time.Duration // Default: 3s
+	Allow       []*net.IPNet  // client networks never delayed or banned
+}
+
+// SetDefault check and set default value
+func (cfg *GuardConf) SetDefault() {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = 15 * time.Minute
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = 100 * time.Millisecond
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = 3 * time.Second
+	}
+}
+
+// Ban banned client ip or user, Key is "ip:<ip>" or "user:<user>"
+type Ban struct {
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+type guardRecord struct {
+	failures []time.Time // failures in window
+	until    time.Time   // banned until
+}
+
+// Guard track failed authentications by client ip and user, delay the
+// failure reply exponentially and ban for BanTime after MaxFailures
+type Guard struct {
+	cfg GuardConf
+
+	mu      sync.Mutex
+	records map[string]*guardRecord
+}
+
+// NewGuard create guard
+func NewGuard(cfg GuardConf) *Guard {
+	cfg.SetDefault()
+	return &Guard{cfg: cfg, records: make(map[string]*guardRecord)}
+}
+
+// MaxDelay max delay of failure reply, servers extend deadline by it
+func (g *Guard) MaxDelay() time.Duration {
+	return g.cfg.MaxDelay
+}
+
+// keys get record keys of client address and user, allowed clients
+// are not tracked
+func (g *Guard) keys(from, user string) []string {
+	ip := from
+	if host, _, err := net.SplitHostPort(from); err == nil {
+		ip = host
+	}
+	if addr := net.ParseIP(ip); addr != nil {
+		for _, n := range g.cfg.Allow {
+			if n.Contains(addr) {
+				return nil
+			}
+		}
+	}
+	var keys []string
+	if len(ip) > 0 {
+		keys = append(keys, "ip:"+ip)
+	}
+	if len(user) > 0 {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// Check check client address and user is not banned, user can be empty
+// before authentication
+func (g *Guard) Check(from, user string) error {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range g.keys(from, user) {
+		if r := g.records[key]; r != nil && now.Before(r.until) {
+			return ErrBanned
+		}
+	}
+	return nil
+}
+
+// Fail record failed authentication, return delay of failure reply
+func (g *Guard) Fail(from, user string) time.Duration {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := g.keys(from, user)
+	if len(keys) == 0 {
+		return 0
+	}
+	full := false
+	if len(g.records) >= maxGuardRecords {
+		g.evict(now)
+		full = len(g.records) >= maxGuardRecords
+	}
+	max := 0
+	for _, key := range keys {
+		r := g.records[key]
+		if r == nil {
+			// user names are chosen by client, only client ips are
+			// tracked when records are still full after evicted
+			if full && strings.HasPrefix(key, "user:") {
+				continue
+			}
+			r = &guardRecord{}
+			g.records[key] = r
+		}
+		r.failures = append(r.prune(now, g.cfg.Window), now)
+		if len(r.failures) > max {
+			max = len(r.failures)
+		}
+		if len(r.failures) >= g.cfg.MaxFailures {
+			r.until = now.Add(g.cfg.BanTime)
+		}
+	}
+	delay := g.cfg.BaseDelay
+	for i := 1; i < max && delay < g.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.cfg.MaxDelay {
+		delay = g.cfg.MaxDelay
+	}
+	return delay
+}
+
+// Success reset failures of client address and user
+func (g *Guard) Success(from, user string) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range g.keys(from, user) {
+		if r := g.records[key]; r != nil && !now.Before(r.until) {
+			delete(g.records, key)
+		}
+	}
+}
+
+// Wrap guard check function, banned client or user is rejected without
+// calling check, failure is replied after backoff delay
+func (g *Guard) Wrap(check func(from, user, pass string) bool) func(from, user, pass string) bool {
+	return func(from, user, pass string) bool {
+		if g.Check(from, user) != nil {
+			time.Sleep(g.cfg.MaxDelay)
+			return false
+		}
+		if check(from, user, pass) {
+			g.Success(from, user)
+			return true
+		}
+		time.Sleep(g.Fail(from, user))
+		return false
+	}
+}
+
+// Bans list banned client ips and users
+func (g *Guard) Bans() []Ban {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ret []Ban
+	for key, r := range g.records {
+		if now.Before(r.until) {
+			ret = append(ret, Ban{Key: key, Failures: len(r.failures), Until: r.until})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// Unban remove ban and failures of key, return false when not found
+func (g *Guard) Unban(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.records[key]
+	delete(g.records, key)
+	return ok
+}
+
+// evict remove records without failures in window and not banned
+func (g *Guard) evict(now time.Time) {
+	for key, r := range g.records {
+		r.failures = r.prune(now, g.cfg.Window)
+		if len(r.failures) == 0 && !now.Before(r.until) {
+			delete(g.records, key)
+		}
+	}
+}
+
+// prune drop failures out of window
+func (r *guardRecord) prune(now time.Time, window time.Duration) []time.Time {
+	n := 0
+	for n < len(r.failures) && now.Sub(r.failures[n]) > window {
+		n++
+	}
+	return r.failures[n:]
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash verified when user not found, so unknown users take the same
+// time as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// Hash hash password by bcrypt
+func Hash(pass string) (string, error) {
+	data, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Verify verify password by hash of htpasswd format, supported bcrypt($2y$),
+// SHA1({SHA}) and MD5($apr1$, $1$)
+func Verify(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return Equal(hash[5:], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, "$apr1$"):
+		return Equal(hash, md5Crypt(pass, hash, "$apr1$"))
+	case strings.HasPrefix(hash, "$1$"):
+		return Equal(hash, md5Crypt(pass, hash, "$1$"))
+	}
+	return false
+}
+
+func verifyMissing(pass string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt md5 based crypt of FreeBSD, apr1 is the same algorithm with
+// different magic, salt is read from hash
+func md5Crypt(pass, hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if n := strings.IndexByte(salt, '$'); n >= 0 {
+		salt = salt[:n]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(pass)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	sum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write(sum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic)
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			sb.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return sb.String()
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Htpasswd users of apache htpasswd file, the file is reloaded when
+// changed, checked at most once per Interval
+type Htpasswd struct {
+	Path     string
+	Interval time.Duration // Default: 1s
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewHtpasswd load htpasswd file
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{Path: path, Interval: time.Second}
+	err := h.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reload htpasswd file, users are kept when failed
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return fmt.Errorf("invalid htpasswd line %d", line)
+		}
+		users[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.users = users
+	h.modTime = fi.ModTime()
+	h.size = fi.Size()
+	h.checked = time.Now()
+	h.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reload file when modify time or size changed
+func (h *Htpasswd) reloadIfChanged() {
+	h.mu.RLock()
+	due := time.Since(h.checked) >= h.Interval
+	h.mu.RUnlock()
+	if !due {
+		return
+	}
+	fi, err := os.Stat(h.Path)
+	h.mu.Lock()
+	h.checked = time.Now()
+	changed := err == nil && (!fi.ModTime().Equal(h.modTime) || fi.Size() != h.size)
+	h.mu.Unlock()
+	if changed {
+		h.Reload()
+	}
+}
+
+// Check check user/pass by hash in file
+func (h *Htpasswd) Check(user, pass string) bool {
+	h.reloadIfChanged()
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		verifyMissing(pass)
+		return false
+	}
+	return Verify(hash, pass)
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDenied user/pass is rejected by backend
+var ErrDenied = errors.New("access denied")
+
+// Identity authenticated user returned by backend
+type Identity struct {
+	User       string
+	Groups     []string
+	Attributes map[string][]string
+}
+
+// InGroup check user is member of any group, true when groups is empty
+func (id *Identity) InGroup(groups ...string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, want := range groups {
+		for _, g := range id.Groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxCacheEntries expired entries are evicted when reached
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	id     *Identity // nil is denied
+	expire time.Time
+}
+
+// resultCache cache allowed results for ttl and denied results for
+// negative ttl, key is hmac by random secret so password is not kept in
+// memory and can not be guessed from dumped keys, identity of last allowed
+// result of each user is kept for handlers
+type resultCache struct {
+	ttl      time.Duration
+	negative time.Duration
+	secret   []byte
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cacheEntry
+	users   map[string]*Identity
+}
+
+func newResultCache(ttl, negative time.Duration) *resultCache {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	return &resultCache{
+		ttl:      ttl,
+		negative: negative,
+		secret:   secret,
+		entries:  make(map[[sha256.Size]byte]cacheEntry),
+		users:    make(map[string]*Identity),
+	}
+}
+
+func (c *resultCache) key(parts ...string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, c.secret)
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// get get cached result, ok is false when not cached
+func (c *resultCache) get(key [sha256.Size]byte) (*Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expire) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	if e.id != nil {
+		c.remember(e.id)
+	}
+	return e.id, true
+}
+
+// remember keep identity of user, must be called with lock held
+func (c *resultCache) remember(id *Identity) {
+	if _, ok := c.users[id.User]; !ok && len(c.users) >= maxCacheEntries {
+		for user := range c.users {
+			delete(c.users, user)
+			break
+		}
+	}
+	c.users[id.User] = id
+}
+
+// identity get identity of last allowed result of user
+func (c *resultCache) identity(user string) (*Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.users[user]
+	return id, ok
+}
+
+// set cache result of backend, errors other than ErrDenied are not cached
+func (c *resultCache) set(key [sha256.Size]byte, id *Identity, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.ttl
+	if err != nil {
+		if !errors.Is(err, ErrDenied) {
+			return
+		}
+		ttl = c.negative
+	} else if id != nil {
+		c.remember(id)
+	}
+	if ttl <= 0 {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = cacheEntry{id: id, expire: time.Now().Add(ttl)}
+}
+
+// purge remove all cached results
+func (c *resultCache) purge() {
+	c.mu.Lock()
+	c.entries = make(map[[sha256.Size]byte]cacheEntry)
+	c.users = make(map[string]*Identity)
+	c.mu.Unlock()
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConf ldap config
+type LDAPConf struct {
+	URL      string      // ldap://host:389 or ldaps://host:636
+	StartTLS bool        // upgrade ldap:// connection by StartTLS
+	TLS      *tls.Config // tls config of ldaps and StartTLS
+	// UserDN bind user directly by dn template, %s is replaced by escaped
+	// user, e.g. uid=%s,ou=people,dc=example,dc=com, search is skipped
+	UserDN string
+	// BindDN/BindPassword service account of search, empty is anonymous
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	Filter       string        // Default: (uid=%s), %s is replaced by escaped user
+	GroupAttr    string        // Default: memberOf
+	Groups       []string      // user must be member of one group, Default: any
+	Attributes   []string      // extra attributes returned in Identity
+	PoolSize     int           // Default: 4
+	Timeout      time.Duration // Default: 5s
+	CacheTTL     time.Duration // Default: 5m
+	NegativeTTL  time.Duration // Default: 30s
+}
+
+// SetDefault check and set default value
+func (cfg *LDAPConf) SetDefault() {
+	if len(cfg.Filter) == 0 {
+		cfg.Filter = "(uid=%s)"
+	}
+	if len(cfg.GroupAttr) == 0 {
+		cfg.GroupAttr = "memberOf"
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = 30 * time.Second
+	}
+}
+
+// LDAP authenticate user by ldap bind
+type LDAP struct {
+	cfg   LDAPConf
+	pool  chan *ldap.Conn
+	cache *resultCache
+}
+
+// NewLDAP create ldap authenticator, connections are created on demand
+func NewLDAP(cfg LDAPConf) *LDAP {
+	cfg.SetDefault()
+	return &LDAP{
+		cfg:   cfg,
+		pool:  make(chan *ldap.Conn, cfg.PoolSize),
+		cache: newResultCache(cfg.CacheTTL, cfg.NegativeTTL),
+	}
+}
+
+// Check check user/pass, can be used as socks5.UserPass.Check
+func (l *LDAP) Check(user, pass string) bool {
+	_, err := l.Authenticate(user, pass)
+	return err == nil
+}
+
+// CheckFrom same as Check, client address is not used
+func (l *LDAP) CheckFrom(from, user, pass string) bool {
+	return l.Check(user, pass)
+}
+
+// Identity get identity of last successful authentication of user, e.g.
+// checked by ConnectUser of proxy handlers for group based acl
+func (l *LDAP) Identity(user string) (*Identity, bool) {
+	return l.cache.identity(user)
+}
+
+// Purge remove cached results
+func (l *LDAP) Purge() {
+	l.cache.purge()
+}
+
+// Close close pooled connections
+func (l *LDAP) Close() {
+	for {
+		select {
+		case conn := <-l.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Authenticate bind user and get groups and attributes, ErrDenied is
+// returned when rejected
+func (l *LDAP) Authenticate(user, pass string) (*Identity, error) {
+	// empty password is unauthenticated bind which always success
+	if len(user) == 0 || len(pass) == 0 {
+		return nil, ErrDenied
+	}
+	key := l.cache.key(user, pass)
+	if id, ok := l.cache.get(key); ok {
+		if id == nil {
+			return nil, ErrDenied
+		}
+		return id, nil
+	}
+	id, err := l.authenticate(user, pass)
+	if err != nil && !errors.Is(err, ErrDenied) {
+		// retry once on broken pooled connection
+		id, err = l.authenticate(user, pass)
+	}
+	l.cache.set(key, id, err)
+	return id, err
+}
+
+func (l *LDAP) authenticate(user, pass string) (*Identity, error) {
+	conn, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	id, err := l.bind(conn, user, pass)
+	if err != nil && !errors.Is(err, ErrDenied) {
+		conn.Close()
+		return nil, err
+	}
+	l.put(conn)
+	return id, err
+}
+
+func (l *LDAP) bind(conn *ldap.Conn, user, pass string) (*Identity, error) {
+	attrs := append([]string{l.cfg.GroupAttr}, l.cfg.Attributes...)
+	var dn string
+	var entry *ldap.Entry
+	if len(l.cfg.UserDN) > 0 {
+		dn = fmt.Sprintf(l.cfg.UserDN, ldap.EscapeDN(user))
+	} else {
+		err := l.bindService(conn)
+		if err != nil {
+			return nil, err
+		}
+		entry, err = l.search(conn, fmt.Sprintf(l.cfg.Filter, ldap.EscapeFilter(user)), attrs)
+		if err != nil {
+			return nil, err
+		}
+		dn = entry.DN
+	}
+	err := conn.Bind(dn, pass)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bind: %v", err)
+	}
+	if entry == nil {
+		// read own entry as user
+		req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(l.cfg.Timeout/time.Second), false, "(objectClass=*)", attrs, nil)
+		ret, err := conn.Search(req)
+		if err == nil && len(ret.Entries) == 1 {
+			entry = ret.Entries[0]
+		}
+	}
+	id := &Identity{User: user, Attributes: make(map[string][]string)}
+	if entry != nil {
+		id.Groups = entry.GetAttributeValues(l.cfg.GroupAttr)
+		for _, attr := range l.cfg.Attributes {
+			id.Attributes[attr] = entry.GetAttributeValues(attr)
+		}
+	}
+	if !id.InGroup(l.cfg.Groups...) {
+		return nil, ErrDenied
+	}
+	return id, nil
+}
+
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	var err error
+	if len(l.cfg.BindDN) == 0 {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(l.cfg.BindDN, l.cfg.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("bind service account: %v", err)
+	}
+	return nil
+}
+
+func (l *LDAP) search(conn *ldap.Conn, filter string, attrs []string) (*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(l.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(l.cfg.Timeout/time.Second), false, filter, attrs, nil)
+	ret, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, ErrDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("search: %v", err)
+	}
+	if len(ret.Entries) != 1 {
+		// not found or ambiguous
+		return nil, ErrDenied
+	}
+	return ret.Entries[0], nil
+}
+
+// get get pooled connection or dial a new one
+func (l *LDAP) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-l.pool:
+			if conn.IsClosing() {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		default:
+			return l.dial()
+		}
+	}
+}
+
+func (l *LDAP) put(conn *ldap.Conn) {
+	select {
+	case l.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	opts := []ldap.DialOpt{ldap.DialWithDialer(&net.Dialer{Timeout: l.cfg.Timeout})}
+	if l.cfg.TLS != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(l.cfg.TLS))
+	}
+	conn, err := ldap.DialURL(l.cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %v", err)
+	}
+	conn.SetTimeout(l.cfg.Timeout)
+	if l.cfg.StartTLS && strings.HasPrefix(l.cfg.URL, "ldap://") {
+		tlsCfg := l.cfg.TLS
+		if tlsCfg == nil {
+			host := strings.TrimPrefix(l.cfg.URL, "ldap://")
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			tlsCfg = &tls.Config{ServerName: host}
+		}
+		err = conn.StartTLS(tlsCfg)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start tls: %v", err)
+		}
+	}
+	return conn, nil
+}
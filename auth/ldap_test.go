@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDirectory minimal ldap server supports simple bind, equality
+// filter search on subtree and base object search
+type fakeDirectory struct {
+	l       net.Listener
+	entries map[string]*ldap.Entry // by dn
+	pass    map[string]string      // by dn
+
+	mu              sync.Mutex
+	binds           []string // bound dn
+	unauthenticated int      // binds with dn and empty password
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{
+		l: l,
+		entries: map[string]*ldap.Entry{
+			"uid=alice,ou=people,dc=example,dc=com": ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":      {"alice"},
+				"mail":     {"alice@example.com"},
+				"memberOf": {"cn=staff,dc=example,dc=com"},
+			}),
+			"uid=bob,ou=people,dc=example,dc=com": ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":      {"bob"},
+				"memberOf": {"cn=guest,dc=example,dc=com"},
+			}),
+		},
+		pass: map[string]string{
+			"cn=svc,dc=example,dc=com":              "svcpass",
+			"uid=alice,ou=people,dc=example,dc=com": "alicepass",
+			"uid=bob,ou=people,dc=example,dc=com":   "bobpass",
+		},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return d
+}
+
+func (d *fakeDirectory) url() string {
+	return "ldap://" + d.l.Addr().String()
+}
+
+func (d *fakeDirectory) bound() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			pass := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultSuccess)
+			// unauthenticated bind with empty password success like real
+			// servers, it is recorded with empty password
+			if len(dn) > 0 {
+				d.mu.Lock()
+				d.binds = append(d.binds, dn)
+				d.mu.Unlock()
+				if want, ok := d.pass[dn]; len(pass) > 0 && (!ok || want != pass) {
+					code = ldap.LDAPResultInvalidCredentials
+				}
+				if len(pass) == 0 {
+					d.unauthenticated++
+				}
+			}
+			d.reply(conn, id, result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Data.String()
+			scope := op.Children[1].Value.(int64)
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, e := range d.search(base, scope, filter) {
+				d.reply(conn, id, encodeEntry(e))
+			}
+			d.reply(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) search(base string, scope int64, filter string) []*ldap.Entry {
+	if scope == ldap.ScopeBaseObject {
+		if e, ok := d.entries[base]; ok {
+			return []*ldap.Entry{e}
+		}
+		return nil
+	}
+	attr, value, _ := strings.Cut(strings.Trim(filter, "()"), "=")
+	var ret []*ldap.Entry
+	for dn, e := range d.entries {
+		if strings.HasSuffix(dn, base) && e.GetAttributeValue(attr) == value {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+func (d *fakeDirectory) reply(conn net.Conn, id int64, op *ber.Packet) {
+	p := ber.NewSequence("LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	conn.Write(p.Bytes())
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return p
+}
+
+func encodeEntry(e *ldap.Entry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+	attrs := ber.NewSequence("attributes")
+	for _, attr := range e.Attributes {
+		a := ber.NewSequence("attribute")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr.Name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range attr.Values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		a.AppendChild(vals)
+		attrs.AppendChild(a)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+func TestLDAPSearchBind(t *testing.T) {
+	d := newFakeDirectory(t)
+	l := NewLDAP(LDAPConf{
+		URL:          d.url(),
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svcpass",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Groups:       []string{"cn=staff,dc=example,dc=com"},
+		Attributes:   []string{"mail"},
+	})
+	defer l.Close()
+
+	id, err := l.Authenticate("alice", "alicepass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "alice" || !id.InGroup("cn=staff,dc=example,dc=com") ||
+		len(id.Attributes["mail"]) != 1 || id.Attributes["mail"][0] != "alice@example.com" {
+		t.Fatalf("identity: %+v", id)
+	}
+	want := []string{"cn=svc,dc=example,dc=com", "uid=alice,ou=people,dc=example,dc=com"}
+	if got := d.bound(); strings.Join(got, ";") != strings.Join(want, ";") {
+		t.Fatalf("binds: %v, want %v", got, want)
+	}
+	// cached
+	if _, err := l.Authenticate("alice", "alicepass"); err != nil || len(d.bound()) != 2 {
+		t.Fatalf("not cached: %v, binds %v", err, d.bound())
+	}
+
+	cases := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"bad password", "alice", "wrong"},
+		{"not in group", "bob", "bobpass"},
+		{"not found", "carol", "x"},
+		{"empty password", "alice", ""},
+		{"empty user", "", "x"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := l.Authenticate(tc.user, tc.pass)
+			if !errors.Is(err, ErrDenied) {
+				t.Fatalf("err: %v, want denied", err)
+			}
+		})
+	}
+	for _, dn := range d.bound() {
+		if strings.HasPrefix(dn, "uid=carol") {
+			t.Fatalf("unexpected bind: %q", dn)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unauthenticated > 0 {
+		t.Fatal("unauthenticated bind sent")
+	}
+}
+
+func TestLDAPUserDN(t *testing.T) {
+	d := newFakeDirectory(t)
+	l := NewLDAP(LDAPConf{
+		URL:    d.url(),
+		UserDN: "uid=%s,ou=people,dc=example,dc=com",
+	})
+	defer l.Close()
+	id, err := l.Authenticate("bob", "bobpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// groups are read from own entry after bind
+	if !id.InGroup("cn=guest,dc=example,dc=com") {
+		t.Fatalf("groups: %v", id.Groups)
+	}
+	if got := d.bound(); len(got) != 1 || got[0] != "uid=bob,ou=people,dc=example,dc=com" {
+		t.Fatalf("binds: %v", got)
+	}
+	if _, err := l.Authenticate("bob", "wrong"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("err: %v, want denied", err)
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import "sync"
+
+// Map users in memory, passwords are stored as hash
+type Map struct {
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewMap create map by user to hash, hash is any format supported by Verify
+func NewMap(users map[string]string) *Map {
+	m := &Map{users: make(map[string]string, len(users))}
+	for user, hash := range users {
+		m.users[user] = hash
+	}
+	return m
+}
+
+// Set set password of user, the password is hashed by bcrypt
+func (m *Map) Set(user, pass string) error {
+	hash, err := Hash(pass)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.users[user] = hash
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete delete user
+func (m *Map) Delete(user string) {
+	m.mu.Lock()
+	delete(m.users, user)
+	m.mu.Unlock()
+}
+
+// Check check user/pass
+func (m *Map) Check(user, pass string) bool {
+	m.mu.RLock()
+	hash, ok := m.users[user]
+	m.mu.RUnlock()
+	if !ok {
+		verifyMissing(pass)
+		return false
+	}
+	return Verify(hash, pass)
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// WebhookConf webhook config
+type WebhookConf struct {
+	URL         string        // url of POST request
+	Header      http.Header   // extra headers, e.g. Authorization
+	Client      *http.Client  // Default: http.Client with Timeout
+	Timeout     time.Duration // Default: 5s
+	CacheTTL    time.Duration // Default: 5m
+	NegativeTTL time.Duration // Default: 30s
+}
+
+// SetDefault check and set default value
+func (cfg *WebhookConf) SetDefault() {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = 30 * time.Second
+	}
+}
+
+// WebhookRequest json body posted to webhook
+type WebhookRequest struct {
+	User   string `json:"user"`
+	Pass   string `json:"pass"`
+	Client string `json:"client,omitempty"` // client ip
+}
+
+// WebhookResponse json body replied by webhook with status 200
+type WebhookResponse struct {
+	Allow      bool                `json:"allow"`
+	Groups     []string            `json:"groups,omitempty"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// Webhook authenticate user by http callback
+type Webhook struct {
+	cfg   WebhookConf
+	cache *resultCache
+}
+
+// NewWebhook create webhook authenticator
+func NewWebhook(cfg WebhookConf) *Webhook {
+	cfg.SetDefault()
+	return &Webhook{cfg: cfg, cache: newResultCache(cfg.CacheTTL, cfg.NegativeTTL)}
+}
+
+// Check check user/pass without client address, can be used as
+// socks5.UserPass.Check
+func (w *Webhook) Check(user, pass string) bool {
+	_, err := w.Authenticate("", user, pass)
+	return err == nil
+}
+
+// CheckFrom check user/pass with client address, can be used as
+// socks5.UserPass.CheckFrom
+func (w *Webhook) CheckFrom(from, user, pass string) bool {
+	_, err := w.Authenticate(from, user, pass)
+	return err == nil
+}
+
+// Identity get identity of last successful authentication of user, e.g.
+// checked by ConnectUser of proxy handlers for group based acl
+func (w *Webhook) Identity(user string) (*Identity, bool) {
+	return w.cache.identity(user)
+}
+
+// Purge remove cached results
+func (w *Webhook) Purge() {
+	w.cache.purge()
+}
+
+// Authenticate post user/pass and client ip to webhook, ErrDenied is
+// returned when rejected, results are cached by user/pass and client ip
+func (w *Webhook) Authenticate(from, user, pass string) (*Identity, error) {
+	if host, _, err := net.SplitHostPort(from); err == nil {
+		from = host
+	}
+	key := w.cache.key(from, user, pass)
+	if id, ok := w.cache.get(key); ok {
+		if id == nil {
+			return nil, ErrDenied
+		}
+		return id, nil
+	}
+	id, err := w.post(WebhookRequest{User: user, Pass: pass, Client: from})
+	w.cache.set(key, id, err)
+	return id, err
+}
+
+func (w *Webhook) post(body WebhookRequest) (*Identity, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range w.cfg.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rep, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post webhook: %v", err)
+	}
+	defer rep.Body.Close()
+	switch rep.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrDenied
+	default:
+		return nil, fmt.Errorf("unexpected webhook status: %d", rep.StatusCode)
+	}
+	var ret WebhookResponse
+	err = json.NewDecoder(io.LimitReader(rep.Body, 1<<20)).Decode(&ret)
+	if err != nil {
+		return nil, fmt.Errorf("decode webhook response: %v", err)
+	}
+	if !ret.Allow {
+		return nil, ErrDenied
+	}
+	return &Identity{User: body.User, Groups: ret.Groups, Attributes: ret.Attributes}, nil
+}
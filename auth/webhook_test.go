@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.User {
+		case "alice":
+			if req.Pass != "secret" || req.Client != "10.0.0.1" {
+				json.NewEncoder(w).Encode(WebhookResponse{Allow: false})
+				return
+			}
+			json.NewEncoder(w).Encode(WebhookResponse{
+				Allow:      true,
+				Groups:     []string{"staff"},
+				Attributes: map[string][]string{"mail": {"alice@example.com"}},
+			})
+		case "unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "broken":
+			w.Write([]byte("{allow"))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer svr.Close()
+
+	cases := []struct {
+		name string
+		user string
+		pass string
+		err  error // nil is allowed, ErrDenied is denied, others any error
+	}{
+		{"allow", "alice", "secret", nil},
+		{"deny", "alice", "wrong", ErrDenied},
+		{"401", "unauthorized", "x", ErrDenied},
+		{"403", "forbidden", "x", ErrDenied},
+		{"bad json", "broken", "x", errors.New("decode")},
+		{"bad status", "other", "x", errors.New("status")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewWebhook(WebhookConf{
+				URL:    svr.URL,
+				Header: http.Header{"Authorization": {"Bearer token"}},
+			})
+			id, err := w.Authenticate("10.0.0.1:1234", tc.user, tc.pass)
+			switch {
+			case tc.err == nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id.User != tc.user || !id.InGroup("staff") ||
+					id.Attributes["mail"][0] != "alice@example.com" {
+					t.Fatalf("identity: %+v", id)
+				}
+				if got, ok := w.Identity(tc.user); !ok || got != id {
+					t.Fatal("identity not kept")
+				}
+			case tc.err == ErrDenied:
+				if !errors.Is(err, ErrDenied) {
+					t.Fatalf("err: %v, want denied", err)
+				}
+			default:
+				if err == nil || errors.Is(err, ErrDenied) {
+					t.Fatalf("err: %v, want backend error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	var calls int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		var req WebhookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.User {
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(WebhookResponse{Allow: req.Pass == "secret"})
+		}
+	}))
+	defer svr.Close()
+	w := NewWebhook(WebhookConf{
+		URL:         svr.URL,
+		CacheTTL:    500 * time.Millisecond,
+		NegativeTTL: 100 * time.Millisecond,
+	})
+	check := func(user, pass string, allow bool, want int64) {
+		t.Helper()
+		if w.Check(user, pass) != allow {
+			t.Fatalf("check %s/%s: %v", user, pass, !allow)
+		}
+		if n := atomic.LoadInt64(&calls); n != want {
+			t.Fatalf("webhook calls: %d, want %d", n, want)
+		}
+	}
+	check("alice", "secret", true, 1)
+	check("alice", "secret", true, 1)
+	check("alice", "wrong", false, 2)
+	check("alice", "wrong", false, 2)
+	// client address is part of key
+	if !w.CheckFrom("10.0.0.1:1", "alice", "secret") || atomic.LoadInt64(&calls) != 3 {
+		t.Fatal("client address not in cache key")
+	}
+	// backend errors are not cached
+	check("error", "x", false, 4)
+	check("error", "x", false, 5)
+
+	time.Sleep(150 * time.Millisecond)
+	check("alice", "wrong", false, 6)
+	check("alice", "secret", true, 6)
+	time.Sleep(400 * time.Millisecond)
+	check("alice", "secret", true, 7)
+
+	w.Purge()
+	if _, ok := w.Identity("alice"); ok {
+		t.Fatal("identity not purged")
+	}
+	check("alice", "secret", true, 8)
+}
@@ -0,0 +1,192 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/internal/udpsession"
+	"github.com/lwch/proxy/outbound"
+	"github.com/lwch/proxy/proxyproto"
+	"github.com/lwch/proxy/sniff"
+)
+
+// ServerHandler server handler
+type ServerHandler interface {
+	LogDebug(format string, a ...interface{})
+	LogError(format string, a ...interface{})
+	LogInfo(format string, a ...interface{})
+	Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+	Forward(local, remote io.ReadWriteCloser)
+}
+
+// UDPHandler optional interface of ServerHandler, ConnectUDP is used
+// for udp sessions and the returned connection must keep message boundaries,
+// when not implemented udp sessions are dialed by ServerConf.Outbound
+type UDPHandler interface {
+	ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
+// ServerConf server config
+type ServerConf struct {
+	// Target fixed target host:port, port of listen address is used when
+	// port is omitted
+	Target string
+	// Routes select target by tls SNI or http Host, key is server name or
+	// domain suffix starts with ".", the longest matched suffix is used and
+	// Target is used when not matched, keys are case insensitive and the
+	// trailing dot is ignored
+	Routes       map[string]string
+	SniffTimeout time.Duration // Default: 300ms
+	UDPTimeout   time.Duration // Default: 60s
+	Handler      ServerHandler
+	Outbound     outbound.Conf // used by default handler and udp sessions
+	// ProxyProtocol accept proxy protocol header of tcp connections from
+	// trusted sources, Default: nil disabled
+	ProxyProtocol *proxyproto.Conf
+}
+
+// SetDefault check and set default value
+func (cfg *ServerConf) SetDefault() {
+	if cfg.SniffTimeout <= 0 {
+		cfg.SniffTimeout = 300 * time.Millisecond
+	}
+	if cfg.UDPTimeout <= 0 {
+		cfg.UDPTimeout = time.Minute
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = defaultServerHandler{out: outbound.New(cfg.Outbound)}
+	}
+	if len(cfg.Routes) > 0 {
+		// matched with lower case sniffed name, map of caller is not modified
+		routes := make(map[string]string, len(cfg.Routes))
+		for k, v := range cfg.Routes {
+			routes[strings.ToLower(strings.TrimSuffix(k, "."))] = v
+		}
+		cfg.Routes = routes
+	}
+}
+
+// Server port forward server
+type Server struct {
+	cfg      ServerConf
+	out      *outbound.Dialer
+	listener net.Listener
+	udp      net.PacketConn
+
+	// runtime
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	sessions map[string]*udpsession.Session
+}
+
+// NewServer create server
+func NewServer(cfg ServerConf) *Server {
+	cfg.SetDefault()
+	svr := &Server{
+		cfg:      cfg,
+		out:      outbound.New(cfg.Outbound),
+		sessions: make(map[string]*udpsession.Session),
+	}
+	svr.ctx, svr.cancel = context.WithCancel(context.Background())
+	return svr
+}
+
+// Shutdown service shutdown
+func (s *Server) Shutdown() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// ListenAndServe listen and forward tcp connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve forward tcp connections accepted by l
+func (s *Server) Serve(l net.Listener) error {
+	if s.cfg.ProxyProtocol != nil {
+		l = proxyproto.NewListener(l, *s.cfg.ProxyProtocol)
+	}
+	s.listener = l
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handleSocket(conn)
+	}
+}
+
+// route get target of server name by Routes
+func (s *Server) route(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if target, ok := s.cfg.Routes[host]; ok {
+		return target, true
+	}
+	// the longest matched suffix is used, map order is random
+	var match, target string
+	for suffix, t := range s.cfg.Routes {
+		if strings.HasPrefix(suffix, ".") && len(suffix) > len(match) &&
+			(strings.HasSuffix(host, suffix) || host == suffix[1:]) {
+			match, target = suffix, t
+		}
+	}
+	return target, len(match) > 0
+}
+
+func (s *Server) target(c net.Conn) (addr.Addr, net.Conn, error) {
+	target := s.cfg.Target
+	if len(s.cfg.Routes) > 0 {
+		var host string
+		host, c = sniff.Sniff(c, s.cfg.SniffTimeout)
+		if t, ok := s.route(host); ok {
+			s.cfg.Handler.LogDebug("route %s to %s", host, t)
+			target = t
+		}
+	}
+	if len(target) == 0 {
+		return addr.Addr{Type: addr.Unknown}, c, errNoTarget
+	}
+	to, err := parseTarget(target, c.LocalAddr())
+	return to, c, err
+}
+
+func (s *Server) handleSocket(c net.Conn) {
+	defer c.Close()
+	to, c, err := s.target(c)
+	if err != nil {
+		s.cfg.Handler.LogError("get target failed" + errInfo(c, err))
+		return
+	}
+	remote, _, err := s.cfg.Handler.Connect(c.RemoteAddr().String(), to)
+	if err != nil {
+		s.cfg.Handler.LogError("connect %s failed"+errInfo(c, err), to.String())
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(c, remote)
+}
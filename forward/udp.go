@@ -0,0 +1,76 @@
+package forward
+
+import (
+	"io"
+	"net"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/internal/udpsession"
+)
+
+// ListenAndServeUDP listen and forward udp datagrams to Target, each client
+// address is forwarded by one session until idle timeout
+func (s *Server) ListenAndServeUDP(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.udp = pc
+	to, err := parseTarget(s.cfg.Target, pc.LocalAddr())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		key := from.String()
+		s.mu.Lock()
+		sess, ok := s.sessions[key]
+		if !ok {
+			sess = udpsession.New(s.cfg.UDPTimeout, func(p []byte) (int, error) {
+				return pc.WriteTo(p, from)
+			})
+			s.sessions[key] = sess
+			go s.handleSession(key, from, sess, to)
+		}
+		s.mu.Unlock()
+		sess.Push(data)
+	}
+}
+
+func (s *Server) handleSession(key string, from net.Addr, sess *udpsession.Session, to addr.Addr) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}()
+	defer sess.Close()
+	var remote io.ReadWriteCloser
+	var err error
+	if h, ok := s.cfg.Handler.(UDPHandler); ok {
+		remote, _, err = h.ConnectUDP(from.String(), to)
+	} else {
+		remote, err = s.out.DialUDP(from.String(), "", to)
+	}
+	if err != nil {
+		s.cfg.Handler.LogError("connect udp %s failed; addr=%s, err=%v",
+			to.String(), from.String(), err)
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(sess, remote)
+}
@@ -0,0 +1,36 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/lwch/proxy/addr"
+)
+
+var errNoTarget = errors.New("no target matched")
+
+func errInfo(c net.Conn, err error) string {
+	return fmt.Sprintf("; addr=%s, err=%v", c.RemoteAddr().String(), err)
+}
+
+// parseTarget parse host:port, port of local is used when omitted
+func parseTarget(target string, local net.Addr) (addr.Addr, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+		_, port, err = net.SplitHostPort(local.String())
+		if err != nil {
+			return addr.Addr{Type: addr.Unknown}, err
+		}
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return addr.Addr{Type: addr.Unknown}, fmt.Errorf("parse port: %v", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr.FromIP(ip, uint16(n)), nil
+	}
+	return addr.Addr{Type: addr.Domain, Domain: host, Port: uint16(n)}, nil
+}
@@ -1,3 +1,17 @@
 module github.com/lwch/proxy
 
-go 1.15
+// go 1.20 is required by http.ResponseController, used to flush and
+// set deadlines of HTTP/2 CONNECT streams and hooked http responses
+go 1.20
+
+require (
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.8
+	golang.org/x/crypto v0.21.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
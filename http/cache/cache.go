@@ -0,0 +1,313 @@
+// Package cache shared http cache, https://www.rfc-editor.org/rfc/rfc9111
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderName header of cache status in response
+const HeaderName = "X-Cache"
+
+// cache status of response
+const (
+	StatusHit         = "HIT"
+	StatusMiss        = "MISS"
+	StatusRevalidated = "REVALIDATED"
+	StatusBypass      = "BYPASS"
+)
+
+// Conf cache config
+type Conf struct {
+	Storage       Storage       // Default: NewMemory(64MB)
+	MaxObjectSize int64         // Default: 8MB, larger responses are not stored
+	MaxHeuristic  time.Duration // Default: 24h, upper bound of heuristic freshness
+}
+
+// SetDefault check and set default value
+func (cfg *Conf) SetDefault() {
+	if cfg.Storage == nil {
+		cfg.Storage, _ = NewMemory(64 << 20)
+	}
+	if cfg.MaxObjectSize <= 0 {
+		cfg.MaxObjectSize = 8 << 20
+	}
+	if cfg.MaxHeuristic <= 0 {
+		cfg.MaxHeuristic = 24 * time.Hour
+	}
+}
+
+// Stats cache metrics
+type Stats struct {
+	Hits        uint64 // served from cache
+	Misses      uint64 // forwarded without usable stored response
+	Revalidated uint64 // stored response validated by 304
+	Bypass      uint64 // not cacheable requests
+	Stored      uint64 // responses written to storage
+	Size        int64  // bytes of storage
+}
+
+// Cache shared http cache
+type Cache struct {
+	cfg Conf
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	revalidated atomic.Uint64
+	bypass      atomic.Uint64
+	stored      atomic.Uint64
+}
+
+// New create cache
+func New(cfg Conf) *Cache {
+	cfg.SetDefault()
+	return &Cache{cfg: cfg}
+}
+
+// Stats get metrics of cache
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Revalidated: c.revalidated.Load(),
+		Bypass:      c.bypass.Load(),
+		Stored:      c.stored.Load(),
+		Size:        c.cfg.Storage.Size(),
+	}
+}
+
+// Transport wrap rt to serve requests by cache
+func (c *Cache) Transport(rt http.RoundTripper) http.RoundTripper {
+	return transport{c: c, rt: rt}
+}
+
+// CheckTransport same as Transport, check is called before any stored
+// response is used for request, e.g. acl of the proxy, the error is
+// returned by RoundTrip when rejected
+func (c *Cache) CheckTransport(rt http.RoundTripper, check func(req *http.Request) error) http.RoundTripper {
+	return transport{c: c, rt: rt, check: check}
+}
+
+type transport struct {
+	c     *Cache
+	rt    http.RoundTripper
+	check func(req *http.Request) error
+}
+
+func cacheKey(u *url.URL) string {
+	v := *u
+	v.Fragment = ""
+	v.RawFragment = ""
+	v.Host = strings.ToLower(v.Host)
+	return v.String()
+}
+
+// cacheable check stored response can be used for request
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, k := range []string{"Range", "If-Range", "If-Match", "If-Unmodified-Since", "Authorization"} {
+		if len(req.Header.Get(k)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.c
+	if !cacheable(req) {
+		c.bypass.Add(1)
+		rep, err := t.rt.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		c.invalidate(req, rep)
+		if req.Method == http.MethodGet && len(req.Header.Get("Authorization")) > 0 {
+			return c.store(req, rep, time.Now()), nil
+		}
+		rep.Header.Set(HeaderName, StatusBypass)
+		return rep, nil
+	}
+	key := cacheKey(req.URL)
+	e := c.load(key, req)
+	if e != nil && t.check != nil {
+		if err := t.check(req); err != nil {
+			return nil, err
+		}
+	}
+	if e != nil && e.fresh(req, time.Now(), c.cfg.MaxHeuristic) {
+		c.hits.Add(1)
+		return e.response(req, time.Now(), StatusHit), nil
+	}
+	if parseDirectives(req.Header).has("only-if-cached") {
+		c.misses.Add(1)
+		return &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{HeaderName: {StatusMiss}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	if e != nil {
+		if etag, lm := e.validators(); len(etag) > 0 || len(lm) > 0 {
+			return t.revalidate(key, req, e)
+		}
+	}
+	c.misses.Add(1)
+	reqTime := time.Now()
+	rep, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.store(req, rep, reqTime), nil
+}
+
+// revalidate send conditional request for stale response,
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3
+func (t transport) revalidate(key string, req *http.Request, e *entry) (*http.Response, error) {
+	c := t.c
+	out := req.Clone(req.Context())
+	out.Method = http.MethodGet
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	etag, lm := e.validators()
+	if len(etag) > 0 {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if len(lm) > 0 {
+		out.Header.Set("If-Modified-Since", lm)
+	}
+	reqTime := time.Now()
+	rep, err := t.rt.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode != http.StatusNotModified {
+		c.misses.Add(1)
+		if req.Method == http.MethodHead {
+			// stored response of GET request is invalid
+			c.cfg.Storage.Delete(key)
+			rep.Body.Close()
+			rep.Body = http.NoBody
+			rep.Header.Set(HeaderName, StatusMiss)
+			return rep, nil
+		}
+		return c.store(req, rep, reqTime), nil
+	}
+	rep.Body.Close()
+	c.revalidated.Add(1)
+	e.freshen(rep.Header, reqTime, time.Now())
+	c.save(key, e)
+	return e.response(req, time.Now(), StatusRevalidated), nil
+}
+
+func (c *Cache) load(key string, req *http.Request) *entry {
+	data, ok := c.cfg.Storage.Get(key)
+	if !ok {
+		return nil
+	}
+	e, err := decodeEntry(data)
+	if err != nil {
+		c.cfg.Storage.Delete(key)
+		return nil
+	}
+	if !e.match(req) {
+		return nil
+	}
+	return e
+}
+
+func (c *Cache) save(key string, e *entry) {
+	data, err := e.encode()
+	if err != nil {
+		return
+	}
+	if int64(len(e.Body)) > c.cfg.MaxObjectSize {
+		return
+	}
+	if c.cfg.Storage.Set(key, data) == nil {
+		c.stored.Add(1)
+	}
+}
+
+// store wrap response body to save entry when body read completely
+func (c *Cache) store(req *http.Request, rep *http.Response, reqTime time.Time) *http.Response {
+	rep.Header.Set(HeaderName, StatusMiss)
+	if !storable(req, rep) || rep.ContentLength > c.cfg.MaxObjectSize {
+		return rep
+	}
+	e := newEntry(req, rep, reqTime, time.Now())
+	if etag, lm := e.validators(); len(etag) == 0 && len(lm) == 0 &&
+		e.lifetime(c.cfg.MaxHeuristic) <= e.age(e.ResponseTime) {
+		// could never be used
+		return rep
+	}
+	key := cacheKey(req.URL)
+	rep.Body = &captureBody{
+		ReadCloser: rep.Body,
+		max:        c.cfg.MaxObjectSize,
+		done: func(body []byte) {
+			e.Body = body
+			c.save(key, e)
+		},
+	}
+	return rep
+}
+
+// invalidate remove stored responses after unsafe request,
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.4
+func (c *Cache) invalidate(req *http.Request, rep *http.Response) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if rep.StatusCode < 200 || rep.StatusCode >= 400 {
+		return
+	}
+	c.cfg.Storage.Delete(cacheKey(req.URL))
+	for _, k := range []string{"Location", "Content-Location"} {
+		u, err := req.URL.Parse(rep.Header.Get(k))
+		if err != nil || len(rep.Header.Get(k)) == 0 || !strings.EqualFold(u.Host, req.URL.Host) {
+			continue
+		}
+		c.cfg.Storage.Delete(cacheKey(u))
+	}
+}
+
+// captureBody copy body while reading until max bytes
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	max      int64
+	done     func([]byte)
+	finished bool
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.finished {
+		return n, err
+	}
+	if int64(b.buf.Len()+n) > b.max {
+		b.finished = true
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.finished = true
+		b.done(b.buf.Bytes())
+	}
+	return n, err
+}
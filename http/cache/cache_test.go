@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type step struct {
+	method string
+	header http.Header
+	status string // want X-Cache
+	body   string // want body when not empty
+	check  func(t *testing.T, rep *http.Response)
+}
+
+func TestTransport(t *testing.T) {
+	cases := []struct {
+		name   string
+		origin func(w http.ResponseWriter, r *http.Request, n int64)
+		steps  []step
+		calls  int64 // want requests of origin
+	}{
+		{
+			name: "max-age",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusHit, body: "body1"},
+				{header: http.Header{"Cache-Control": {"no-cache"}}, status: StatusMiss, body: "body2"},
+			},
+			calls: 2,
+		},
+		{
+			name: "expires",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				now := time.Now()
+				w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+				w.Header().Set("Expires", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusHit, body: "body1"},
+			},
+			calls: 1,
+		},
+		{
+			name: "expired",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Expires", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusMiss, body: "body2"},
+			},
+			calls: 2,
+		},
+		{
+			name: "no-store",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60, no-store")
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusMiss, body: "body2"},
+			},
+			calls: 2,
+		},
+		{
+			name: "private",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "private, max-age=60")
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusMiss, body: "body2"},
+			},
+			calls: 2,
+		},
+		{
+			name: "vary",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+				fmt.Fprintf(w, "%s%d", r.Header.Get("Accept-Language"), n)
+			},
+			steps: []step{
+				{header: http.Header{"Accept-Language": {"en"}}, status: StatusMiss, body: "en1"},
+				{header: http.Header{"Accept-Language": {"en"}}, status: StatusHit, body: "en1"},
+				{header: http.Header{"Accept-Language": {"fr"}}, status: StatusMiss, body: "fr2"},
+			},
+			calls: 2,
+		},
+		{
+			name: "revalidate",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=0")
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("X-Version", fmt.Sprint(n))
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				io.WriteString(w, "body")
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body"},
+				{status: StatusRevalidated, body: "body", check: func(t *testing.T, rep *http.Response) {
+					if v := rep.Header.Get("X-Version"); v != "2" {
+						t.Fatalf("header not refreshed: X-Version=%s", v)
+					}
+				}},
+				{status: StatusRevalidated, body: "body", check: func(t *testing.T, rep *http.Response) {
+					if v := rep.Header.Get("X-Version"); v != "3" {
+						t.Fatalf("header not refreshed: X-Version=%s", v)
+					}
+				}},
+			},
+			calls: 3,
+		},
+		{
+			name: "invalidate",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				if r.Method == http.MethodGet {
+					w.Header().Set("Cache-Control", "max-age=60")
+				}
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{status: StatusMiss, body: "body1"},
+				{status: StatusHit, body: "body1"},
+				{method: http.MethodPost, status: StatusBypass, body: "body2"},
+				{status: StatusMiss, body: "body3"},
+			},
+			calls: 3,
+		},
+		{
+			name: "only-if-cached",
+			origin: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprintf(w, "body%d", n)
+			},
+			steps: []step{
+				{header: http.Header{"Cache-Control": {"only-if-cached"}}, status: StatusMiss, check: func(t *testing.T, rep *http.Response) {
+					if rep.StatusCode != http.StatusGatewayTimeout {
+						t.Fatalf("status: %d", rep.StatusCode)
+					}
+				}},
+				{status: StatusMiss, body: "body1"},
+				{header: http.Header{"Cache-Control": {"only-if-cached"}}, status: StatusHit, body: "body1"},
+			},
+			calls: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int64
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.origin(w, r, atomic.AddInt64(&calls, 1))
+			}))
+			defer origin.Close()
+			cli := &http.Client{Transport: New(Conf{}).Transport(http.DefaultTransport)}
+			for i, st := range tc.steps {
+				method := st.method
+				if len(method) == 0 {
+					method = http.MethodGet
+				}
+				req, err := http.NewRequest(method, origin.URL+"/"+tc.name, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range st.header {
+					req.Header[k] = v
+				}
+				rep, err := cli.Do(req)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				body, err := io.ReadAll(rep.Body)
+				rep.Body.Close()
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if got := rep.Header.Get(HeaderName); got != st.status {
+					t.Fatalf("step %d: %s=%s, want %s", i, HeaderName, got, st.status)
+				}
+				if len(st.body) > 0 && string(body) != st.body {
+					t.Fatalf("step %d: body=%q, want %q", i, body, st.body)
+				}
+				if st.check != nil {
+					st.check(t, rep)
+				}
+			}
+			if n := atomic.LoadInt64(&calls); n != tc.calls {
+				t.Fatalf("origin requests: %d, want %d", n, tc.calls)
+			}
+		})
+	}
+}
+
+func TestCheckTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+	c := New(Conf{})
+	deny := fmt.Errorf("denied")
+	allowed := &http.Client{Transport: c.CheckTransport(http.DefaultTransport, func(*http.Request) error {
+		return nil
+	})}
+	denied := &http.Client{Transport: c.CheckTransport(http.DefaultTransport, func(*http.Request) error {
+		return deny
+	})}
+	for i := 0; i < 2; i++ {
+		rep, err := allowed.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, rep.Body)
+		rep.Body.Close()
+	}
+	_, err := denied.Get(origin.URL)
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("stored response served without check: %v", err)
+	}
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewDisk(dir, 0); err == nil {
+		t.Fatal("zero max size accepted")
+	}
+	d, err := NewDisk(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := d.Set(k, []byte("12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, ok := d.Get("a"); !ok || string(data) != "12345" {
+		t.Fatalf("get a: %q %v", data, ok)
+	}
+	// b is least recently used
+	if err := d.Set("c", []byte("67890")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	if d.Size() != 10 {
+		t.Fatalf("size: %d", d.Size())
+	}
+	// larger than max size is not stored
+	if err := d.Set("d", []byte("0123456789x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Get("d"); ok {
+		t.Fatal("oversized data stored")
+	}
+
+	// reload files from directory
+	d, err = NewDisk(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := d.Get(k); !ok {
+			t.Fatalf("%s not reloaded", k)
+		}
+	}
+	if d.Size() != 10 {
+		t.Fatalf("reloaded size: %d", d.Size())
+	}
+	d.Delete("a")
+	if _, ok := d.Get("a"); ok || d.Size() != 5 {
+		t.Fatalf("delete: size %d", d.Size())
+	}
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives parsed Cache-Control directives, https://www.rfc-editor.org/rfc/rfc9111#section-5.2
+type directives map[string]string
+
+func parseDirectives(h http.Header) directives {
+	d := make(directives)
+	for _, v := range h.Values("Cache-Control") {
+		for len(v) > 0 {
+			var item string
+			item, v = nextDirective(v)
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+			k, val, _ := strings.Cut(item, "=")
+			k = strings.ToLower(strings.TrimSpace(k))
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+			if _, ok := d[k]; !ok {
+				d[k] = val
+			}
+		}
+	}
+	return d
+}
+
+// nextDirective split first directive, commas in quoted string are kept
+func nextDirective(v string) (string, string) {
+	quoted := false
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				return v[:i], v[i+1:]
+			}
+		}
+	}
+	return v, ""
+}
+
+func (d directives) has(k string) bool {
+	_, ok := d[k]
+	return ok
+}
+
+// seconds get delta-seconds value, invalid value is treated as 0
+func (d directives) seconds(k string) (time.Duration, bool) {
+	v, ok := d[k]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// statuses understood by cache
+var understood = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusFound:                true,
+	http.StatusSeeOther:             true,
+	http.StatusTemporaryRedirect:    true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// heuristically cacheable statuses, https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+var heuristic = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// storable check response can be stored by shared cache,
+// https://www.rfc-editor.org/rfc/rfc9111#section-3
+func storable(req *http.Request, rep *http.Response) bool {
+	if req.Method != http.MethodGet || !understood[rep.StatusCode] {
+		return false
+	}
+	reqCC := parseDirectives(req.Header)
+	repCC := parseDirectives(rep.Header)
+	if reqCC.has("no-store") || repCC.has("no-store") || repCC.has("private") {
+		return false
+	}
+	if len(req.Header.Get("Authorization")) > 0 &&
+		!repCC.has("must-revalidate") && !repCC.has("public") && !repCC.has("s-maxage") {
+		return false
+	}
+	if len(rep.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, name := range varyFields(rep.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return repCC.has("public") || repCC.has("max-age") || repCC.has("s-maxage") ||
+		len(rep.Header.Get("Expires")) > 0 || heuristic[rep.StatusCode]
+}
+
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				fields = append(fields, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return fields
+}
+
+func headerTime(h http.Header, k string) (time.Time, bool) {
+	v := h.Get(k)
+	if len(v) == 0 {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// disk lru storage of files in directory
+type disk struct {
+	dir string
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+// NewDisk create lru storage in dir, exists files are loaded by
+// modification time, least recently used files are removed when size
+// exceeds maxSize
+func NewDisk(dir string, maxSize int64) (Storage, error) {
+	if maxSize <= 0 {
+		return nil, errMaxSize
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// removed after listed
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	d := &disk{
+		dir:   dir,
+		max:   maxSize,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	for _, f := range files {
+		d.items[f.Name()] = d.lru.PushBack(diskItem{name: f.Name(), size: f.Size()})
+		d.size += f.Size()
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	return d, nil
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *disk) Get(key string) ([]byte, bool) {
+	name := fileName(key)
+	d.mu.Lock()
+	e, ok := d.items[name]
+	if ok {
+		d.lru.MoveToFront(e)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		d.Delete(key)
+		return nil, false
+	}
+	return data, true
+}
+
+func (d *disk) Set(key string, data []byte) error {
+	name := fileName(key)
+	if int64(len(data)) > d.max {
+		d.Delete(key)
+		return nil
+	}
+	f, err := os.CreateTemp(d.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(d.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.items[name]; ok {
+		d.size -= e.Value.(diskItem).size
+		d.lru.Remove(e)
+	}
+	d.items[name] = d.lru.PushFront(diskItem{name: name, size: int64(len(data))})
+	d.size += int64(len(data))
+	d.evict()
+	return nil
+}
+
+func (d *disk) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(fileName(key))
+}
+
+func (d *disk) evict() {
+	for d.size > d.max {
+		d.remove(d.lru.Back().Value.(diskItem).name)
+	}
+}
+
+func (d *disk) remove(name string) {
+	e, ok := d.items[name]
+	if !ok {
+		return
+	}
+	d.lru.Remove(e)
+	delete(d.items, name)
+	d.size -= e.Value.(diskItem).size
+	os.Remove(filepath.Join(d.dir, name))
+}
+
+func (d *disk) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry stored response
+type entry struct {
+	StatusCode   int
+	ProtoMajor   int
+	ProtoMinor   int
+	Header       http.Header
+	Body         []byte
+	Vary         map[string]string // request header values selected by Vary
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+func newEntry(req *http.Request, rep *http.Response, reqTime, repTime time.Time) *entry {
+	e := &entry{
+		StatusCode:   rep.StatusCode,
+		ProtoMajor:   rep.ProtoMajor,
+		ProtoMinor:   rep.ProtoMinor,
+		Header:       rep.Header.Clone(),
+		Vary:         make(map[string]string),
+		RequestTime:  reqTime,
+		ResponseTime: repTime,
+	}
+	removeHopHeaders(e.Header)
+	e.Header.Del(HeaderName)
+	for _, name := range varyFields(rep.Header) {
+		e.Vary[name] = varyValue(req.Header, name)
+	}
+	return e
+}
+
+func varyValue(h http.Header, name string) string {
+	values := h.Values(name)
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func decodeEntry(data []byte) (*entry, error) {
+	var e entry
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (e *entry) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// match check request headers selected by Vary
+func (e *entry) match(req *http.Request) bool {
+	for name, v := range e.Vary {
+		if varyValue(req.Header, name) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// age current age, https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3
+func (e *entry) age(now time.Time) time.Duration {
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	var apparent time.Duration
+	if date, ok := headerTime(e.Header, "Date"); ok && e.ResponseTime.After(date) {
+		apparent = e.ResponseTime.Sub(date)
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// lifetime freshness lifetime, https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (e *entry) lifetime(maxHeuristic time.Duration) time.Duration {
+	cc := parseDirectives(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, ok := headerTime(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	if len(e.Header.Get("Expires")) > 0 {
+		// invalid Expires means already expired
+		expires, _ := headerTime(e.Header, "Expires")
+		return expires.Sub(date)
+	}
+	if lm, ok := headerTime(e.Header, "Last-Modified"); ok && heuristic[e.StatusCode] && date.After(lm) {
+		d := date.Sub(lm) / 10
+		if d > maxHeuristic {
+			d = maxHeuristic
+		}
+		return d
+	}
+	return 0
+}
+
+// fresh check stored response can be used without validation,
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2
+func (e *entry) fresh(req *http.Request, now time.Time, maxHeuristic time.Duration) bool {
+	reqCC := parseDirectives(req.Header)
+	repCC := parseDirectives(e.Header)
+	if reqCC.has("no-cache") || repCC.has("no-cache") {
+		return false
+	}
+	if len(req.Header.Values("Cache-Control")) == 0 &&
+		strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		return false
+	}
+	age := e.age(now)
+	lifetime := e.lifetime(maxHeuristic)
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		age += d
+	}
+	if age < lifetime {
+		return true
+	}
+	// s-maxage implies proxy-revalidate for shared cache
+	if repCC.has("must-revalidate") || repCC.has("proxy-revalidate") || repCC.has("s-maxage") {
+		return false
+	}
+	v, ok := reqCC["max-stale"]
+	if !ok {
+		return false
+	}
+	if len(v) == 0 {
+		return true
+	}
+	d, _ := reqCC.seconds("max-stale")
+	return age-lifetime <= d
+}
+
+func (e *entry) validators() (string, string) {
+	return e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+}
+
+// freshen update stored headers by 304 response, https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4
+func (e *entry) freshen(h http.Header, reqTime, repTime time.Time) {
+	h = h.Clone()
+	removeHopHeaders(h)
+	for _, k := range []string{"Content-Length", "Content-Encoding", "Content-Range", HeaderName} {
+		h.Del(k)
+	}
+	for k, v := range h {
+		e.Header[k] = v
+	}
+	e.RequestTime = reqTime
+	e.ResponseTime = repTime
+}
+
+// response build response of stored entry
+func (e *entry) response(req *http.Request, now time.Time, status string) *http.Response {
+	rep := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         fmt.Sprintf("HTTP/%d.%d", e.ProtoMajor, e.ProtoMinor),
+		ProtoMajor:    e.ProtoMajor,
+		ProtoMinor:    e.ProtoMinor,
+		Header:        e.Header.Clone(),
+		ContentLength: int64(len(e.Body)),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		Request:       req,
+	}
+	rep.Header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	rep.Header.Set(HeaderName, status)
+	if notModified(req, e.Header) {
+		rep.Status = "304 Not Modified"
+		rep.StatusCode = http.StatusNotModified
+		rep.ContentLength = 0
+		rep.Body = http.NoBody
+		for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			rep.Header.Del(k)
+		}
+	} else if req.Method == http.MethodHead {
+		rep.Body = http.NoBody
+	}
+	return rep
+}
+
+// notModified evaluate conditional request of client, https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2
+func notModified(req *http.Request, h http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, ok := headerTime(req.Header, "If-Modified-Since")
+	if !ok {
+		return false
+	}
+	lm, ok := headerTime(h, "Last-Modified")
+	return ok && !lm.After(ims)
+}
+
+// hop-by-hop headers are not stored, https://www.rfc-editor.org/rfc/rfc9111#section-3.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); len(k) > 0 {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+var errMaxSize = errors.New("max size of storage must be positive")
+
+// Storage storage of encoded responses, implementations must be safe for
+// concurrent use
+type Storage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte) error
+	Delete(key string)
+	// Size total bytes of stored data
+	Size() int64
+}
+
+type memoryItem struct {
+	key  string
+	data []byte
+}
+
+// memory lru storage in memory
+type memory struct {
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+// NewMemory create lru storage in memory, least recently used data is
+// evicted when size exceeds maxSize
+func NewMemory(maxSize int64) (Storage, error) {
+	if maxSize <= 0 {
+		return nil, errMaxSize
+	}
+	return &memory{
+		max:   maxSize,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}, nil
+}
+
+func (m *memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(memoryItem).data, true
+}
+
+func (m *memory) Set(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	if int64(len(data)) > m.max {
+		return nil
+	}
+	m.items[key] = m.lru.PushFront(memoryItem{key: key, data: data})
+	m.size += int64(len(data))
+	for m.size > m.max {
+		m.remove(m.lru.Back().Value.(memoryItem).key)
+	}
+	return nil
+}
+
+func (m *memory) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+func (m *memory) remove(key string) {
+	e, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(e)
+	delete(m.items, key)
+	m.size -= int64(len(e.Value.(memoryItem).data))
+}
+
+func (m *memory) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
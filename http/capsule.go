@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// capsule types, RFC 9297
+const (
+	capsuleDatagram = 0x00
+)
+
+// maxDatagram max udp payload in one capsule
+const maxDatagram = 64 * 1024
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// readVarint read quic variable-length integer, RFC 9000 section 16
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// appendVarint append quic variable-length integer
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// capsuleConn datagram connection over capsule protocol stream, each Read
+// returns one udp payload and each Write sends one udp payload
+type capsuleConn struct {
+	r  *bufio.Reader
+	w  io.Writer
+	c  io.Closer
+	mu sync.Mutex
+}
+
+func newCapsuleConn(r io.Reader, w io.Writer, c io.Closer) *capsuleConn {
+	return &capsuleConn{r: bufio.NewReader(r), w: w, c: c}
+}
+
+// Read read next DATAGRAM capsule with context id 0, unknown capsules are skipped
+func (c *capsuleConn) Read(p []byte) (int, error) {
+	for {
+		typ, err := readVarint(c.r)
+		if err != nil {
+			return 0, err
+		}
+		size, err := readVarint(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if size > maxDatagram+8 {
+			return 0, errCapsuleTooLarge
+		}
+		if typ != capsuleDatagram {
+			_, err = io.CopyN(io.Discard, c.r, int64(size))
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(c.r, payload)
+		if err != nil {
+			return 0, err
+		}
+		pr := bytes.NewReader(payload)
+		ctx, err := readVarint(pr)
+		if err != nil || ctx != 0 {
+			// drop datagram with unknown context id
+			continue
+		}
+		return copy(p, payload[len(payload)-pr.Len():]), nil
+	}
+}
+
+// Write send udp payload in DATAGRAM capsule with context id 0
+func (c *capsuleConn) Write(p []byte) (int, error) {
+	buf := appendVarint(nil, capsuleDatagram)
+	buf = appendVarint(buf, uint64(len(p)+1))
+	buf = append(buf, 0)
+	buf = append(buf, p...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *capsuleConn) Close() error {
+	return c.c.Close()
+}
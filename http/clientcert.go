@@ -0,0 +1,329 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ClientCertMode verification mode of client certificate
+type ClientCertMode int
+
+const (
+	// ClientCertOptional verify certificate when presented, clients
+	// without certificate are checked by user/pass
+	ClientCertOptional ClientCertMode = iota
+	// ClientCertRequired tls handshake fails without valid certificate
+	ClientCertRequired
+)
+
+// ClientCertUser certificate field mapped to user
+type ClientCertUser int
+
+const (
+	CertCommonName ClientCertUser = iota // subject common name
+	CertEmail                            // first email SAN
+	CertDNS                              // first dns SAN
+	CertURI                              // first uri SAN
+)
+
+// ClientCertConf client certificate authentication config
+type ClientCertConf struct {
+	CA   string         // pem file of client ca certificates
+	Mode ClientCertMode // Default: ClientCertOptional
+	User ClientCertUser // Default: CertCommonName
+	// UserFunc map certificate to user, used instead of User when set
+	UserFunc func(cert *x509.Certificate) (string, error)
+	// CRL pem or der revocation list files, reloaded when changed,
+	// certificates are rejected when matched list passed NextUpdate
+	CRL []string
+	// OCSP check revocation by querying ocsp responder of certificate
+	// instead of ocsp staple, go tls server does not receive staple of
+	// client certificate
+	OCSP bool
+	// OCSPHardFail reject certificate when responder is unreachable,
+	// Default: false accept
+	OCSPHardFail bool
+	OCSPTimeout  time.Duration // Default: 5s
+}
+
+// SetDefault check and set default value
+func (cfg *ClientCertConf) SetDefault() {
+	if cfg.OCSPTimeout <= 0 {
+		cfg.OCSPTimeout = 5 * time.Second
+	}
+}
+
+var errRevoked = errors.New("certificate revoked")
+
+// crlFile revocation list of one file
+type crlFile struct {
+	path    string
+	modTime time.Time
+	lists   []*x509.RevocationList
+}
+
+type ocspResult struct {
+	status int
+	expire time.Time
+}
+
+// clientCert verify client certificate and map to user
+type clientCert struct {
+	cfg ClientCertConf
+	cli *http.Client
+
+	mu      sync.Mutex
+	crls    []*crlFile
+	checked time.Time
+	ocsp    map[string]ocspResult // key is issuer and serial
+}
+
+func newClientCert(cfg ClientCertConf) (*clientCert, *tls.Config, error) {
+	cfg.SetDefault()
+	data, err := os.ReadFile(cfg.CA)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, nil, fmt.Errorf("no certificate found in %s", cfg.CA)
+	}
+	cc := &clientCert{
+		cfg:  cfg,
+		cli:  &http.Client{Timeout: cfg.OCSPTimeout},
+		ocsp: make(map[string]ocspResult),
+	}
+	for _, path := range cfg.CRL {
+		f := &crlFile{path: path}
+		err = f.load()
+		if err != nil {
+			return nil, nil, fmt.Errorf("load crl %s: %v", path, err)
+		}
+		cc.crls = append(cc.crls, f)
+	}
+	cc.checked = time.Now()
+	tlsCfg := &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		// VerifyPeerCertificate is not called on resumed connections
+		VerifyConnection: cc.verify,
+	}
+	if cfg.Mode == ClientCertRequired {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cc, tlsCfg, nil
+}
+
+// load parse all pem blocks or der of file
+func (f *crlFile) load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	var lists []*x509.RevocationList
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return err
+			}
+			lists = append(lists, crl)
+		}
+	} else {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return err
+		}
+		lists = append(lists, crl)
+	}
+	f.lists = lists
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// revocationLists get revocation lists, files are reloaded when changed
+// and checked at most once per 10 seconds
+func (cc *clientCert) revocationLists() []*x509.RevocationList {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if time.Since(cc.checked) >= 10*time.Second {
+		cc.checked = time.Now()
+		for _, f := range cc.crls {
+			fi, err := os.Stat(f.path)
+			if err == nil && !fi.ModTime().Equal(f.modTime) {
+				f.load()
+			}
+		}
+	}
+	var ret []*x509.RevocationList
+	for _, f := range cc.crls {
+		ret = append(ret, f.lists...)
+	}
+	return ret
+}
+
+// verify check revocation of verified chains, called on full and resumed
+// handshakes after chain verified
+func (cc *clientCert) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	chain := cs.VerifiedChains[0]
+	lists := cc.revocationLists()
+	now := time.Now()
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range lists {
+			if crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				return fmt.Errorf("crl of %s expired at %s", issuer.Subject, crl.NextUpdate)
+			}
+			for _, revoked := range crl.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("%w by crl, serial=%s", errRevoked, cert.SerialNumber)
+				}
+			}
+		}
+		if cc.cfg.OCSP && len(cert.OCSPServer) > 0 {
+			err := cc.checkOCSP(cert, issuer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkOCSP query responder, result is cached until NextUpdate
+func (cc *clientCert) checkOCSP(cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubjectPublicKeyInfo) + cert.SerialNumber.String()
+	cc.mu.Lock()
+	ret, ok := cc.ocsp[key]
+	if ok && time.Now().After(ret.expire) {
+		delete(cc.ocsp, key)
+		ok = false
+	}
+	cc.mu.Unlock()
+	if !ok {
+		rep, err := cc.queryOCSP(cert, issuer)
+		if err != nil {
+			if cc.cfg.OCSPHardFail {
+				return fmt.Errorf("ocsp: %v", err)
+			}
+			return nil
+		}
+		ret = ocspResult{status: rep.Status, expire: rep.NextUpdate}
+		if ret.expire.IsZero() {
+			ret.expire = time.Now().Add(time.Hour)
+		}
+		cc.mu.Lock()
+		cc.ocsp[key] = ret
+		cc.mu.Unlock()
+	}
+	switch ret.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w by ocsp, serial=%s", errRevoked, cert.SerialNumber)
+	}
+	if cc.cfg.OCSPHardFail {
+		return fmt.Errorf("ocsp: unknown status, serial=%s", cert.SerialNumber)
+	}
+	return nil
+}
+
+func (cc *clientCert) queryOCSP(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, server := range cert.OCSPServer {
+		rep, err := cc.cli.Post(server, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(rep.Body, 1<<20))
+		rep.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if rep.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("unexpected status: %d", rep.StatusCode)
+			continue
+		}
+		ret, err := ocsp.ParseResponseForCert(data, cert, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return ret, nil
+	}
+	return nil, lastErr
+}
+
+// user map verified client certificate to user
+func (cc *clientCert) user(cert *x509.Certificate) (string, error) {
+	if cc.cfg.UserFunc != nil {
+		return cc.cfg.UserFunc(cert)
+	}
+	var user string
+	switch cc.cfg.User {
+	case CertCommonName:
+		user = cert.Subject.CommonName
+	case CertEmail:
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case CertDNS:
+		if len(cert.DNSNames) > 0 {
+			user = cert.DNSNames[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			user = cert.URIs[0].String()
+		}
+	}
+	if len(strings.TrimSpace(user)) == 0 {
+		return "", errors.New("no user field in certificate")
+	}
+	return user, nil
+}
+
+// certUser get user of verified client certificate, ok is false when
+// no certificate presented
+func (s *Server) certUser(req *http.Request) (string, bool, error) {
+	if s.clientCert == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+	user, err := s.clientCert.user(req.TLS.VerifiedChains[0][0])
+	return user, true, err
+}
@@ -0,0 +1,257 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hop-by-hop headers, https://tools.ietf.org/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); len(k) > 0 {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// directDial context key of upgrade requests, the connection is tunneled
+// by ServerHandler.Forward after switched, so it is not relayed on dial
+type directDial struct{}
+
+// newTransport create transport connecting origin servers by handler
+func (s *Server) newTransport(from, user string, tlsCfg *tls.Config) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			remote, _, err := s.connect(from, user, parseAddr(address, 80))
+			if err != nil {
+				return nil, err
+			}
+			if ctx.Value(directDial{}) != nil {
+				return toConn(remote), nil
+			}
+			// data is relayed by ServerHandler.Forward, so the handler
+			// still sees traffic of plain requests
+			local, conn := net.Pipe()
+			go func() {
+				defer remote.Close()
+				defer conn.Close()
+				s.cfg.Handler.Forward(conn, remote)
+			}()
+			return local, nil
+		},
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+}
+
+type clientTransport struct {
+	user string
+	tr   *http.Transport
+}
+
+// transport get transport of client connection, the idle connections
+// are closed when client connection closed
+func (s *Server) transport(from, user string) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.transports[from]
+	if ct != nil && ct.user == user {
+		return ct.tr
+	}
+	if ct != nil {
+		ct.tr.CloseIdleConnections()
+	}
+	ct = &clientTransport{user: user, tr: s.newTransport(from, user, nil)}
+	s.transports[from] = ct
+	return ct.tr
+}
+
+func (s *Server) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	from := c.RemoteAddr().String()
+	s.mu.Lock()
+	ct := s.transports[from]
+	delete(s.transports, from)
+	s.mu.Unlock()
+	if ct != nil {
+		ct.tr.CloseIdleConnections()
+	}
+}
+
+// roundTrip forward request to origin server and write back response
+func (s *Server) roundTrip(w http.ResponseWriter, req *http.Request, rt http.RoundTripper) {
+	// forwarding may take longer than server timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	if req.ContentLength == 0 {
+		out.Body = nil
+	}
+	te := strings.EqualFold(req.Header.Get("Te"), "trailers")
+	upgrade := upgradeType(req.Header)
+	settings := req.Header.Values("Http2-Settings")
+	removeHopHeaders(out.Header)
+	if te {
+		// required by grpc
+		out.Header.Set("Te", "trailers")
+	}
+	if len(upgrade) > 0 {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+	}
+	if strings.EqualFold(upgrade, "h2c") && len(settings) > 0 {
+		// server must not upgrade without it, RFC 7540 section 3.2
+		out.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+		out.Header["Http2-Settings"] = settings
+	}
+	s.setForwarded(out, req)
+	if tr, ok := rt.(*http.Transport); ok && len(upgrade) > 0 {
+		// direct connections must not be pooled for plain requests
+		tr = tr.Clone()
+		tr.DisableKeepAlives = true
+		rt = tr
+		out = out.WithContext(context.WithValue(out.Context(), directDial{}, true))
+	}
+	rep, err := s.do(out, rt)
+	if err != nil {
+		s.cfg.Handler.LogError("round trip %s failed"+errInfo(req.RemoteAddr, err), req.URL.String())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rep.Body.Close()
+	if rep.StatusCode == http.StatusSwitchingProtocols {
+		s.switchProtocols(w, req, rep, upgrade)
+		return
+	}
+	removeHopHeaders(rep.Header)
+	s.addVia(rep.Header, rep.ProtoMajor, rep.ProtoMinor)
+	writeResponse(w, rep)
+}
+
+// upgradeType get protocol of Upgrade header when Connection has upgrade token
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(k), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// switchProtocols reply 101 response to client and tunnel client
+// connection with origin connection
+func (s *Server) switchProtocols(w http.ResponseWriter, req *http.Request, rep *http.Response, upgrade string) {
+	remote, ok := rep.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.cfg.Handler.LogError("switch protocols failed, addr=%s, err=body not writable", req.RemoteAddr)
+		http.Error(w, "switch protocols: body not writable", http.StatusBadGateway)
+		return
+	}
+	got := upgradeType(rep.Header)
+	if len(upgrade) == 0 || !strings.EqualFold(got, upgrade) {
+		s.cfg.Handler.LogError("switch protocols failed, addr=%s, err=upgrade %q mismatch %q",
+			req.RemoteAddr, got, upgrade)
+		http.Error(w, "switch protocols: upgrade mismatch", http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.cfg.Handler.LogError("not supported hijacker, addr=%s", req.RemoteAddr)
+		http.Error(w, "not supported hijacker", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.cfg.Handler.LogError("hijack failed" + errInfo(req.RemoteAddr, err))
+		http.Error(w, fmt.Sprintf("hijack: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+	removeHopHeaders(rep.Header)
+	rep.Header.Set("Connection", "Upgrade")
+	rep.Header.Set("Upgrade", got)
+	s.addVia(rep.Header, rep.ProtoMajor, rep.ProtoMinor)
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rep.Header.Write(brw)
+	brw.WriteString("\r\n")
+	err = brw.Flush()
+	if err != nil {
+		s.cfg.Handler.LogError("reply switch protocols failed" + errInfo(req.RemoteAddr, err))
+		return
+	}
+	var local io.ReadWriteCloser = conn
+	if brw.Reader.Buffered() > 0 {
+		local = bufConn{Conn: conn, r: brw.Reader}
+	}
+	s.cfg.Handler.Forward(local, remote)
+}
+
+// writeResponse write response header and stream body to w
+func writeResponse(w http.ResponseWriter, rep *http.Response) {
+	hdr := w.Header()
+	for k, v := range rep.Header {
+		hdr[k] = append(hdr[k][:0:0], v...)
+	}
+	for k := range rep.Trailer {
+		hdr.Add("Trailer", k)
+	}
+	w.WriteHeader(rep.StatusCode)
+	flushCopy(w, rep.Body)
+	for k, v := range rep.Trailer {
+		hdr[http.TrailerPrefix+k] = v
+	}
+}
+
+// flushCopy copy body and flush every write for streaming response
+func flushCopy(w http.ResponseWriter, r io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ForwardMode forwarded header handling mode
+type ForwardMode int
+
+const (
+	// ForwardOff keep incoming values and add nothing
+	ForwardOff ForwardMode = iota
+	// ForwardAppend append client to incoming values, incoming values
+	// from untrusted clients are removed
+	ForwardAppend
+	// ForwardReplace replace incoming values by client
+	ForwardReplace
+	// ForwardStrip remove incoming values and add nothing
+	ForwardStrip
+)
+
+// ForwardedConf Forwarded, X-Forwarded-* and Via headers config
+type ForwardedConf struct {
+	Forwarded  ForwardMode  // RFC 7239 Forwarded header, Default: ForwardOff
+	XForwarded ForwardMode  // X-Forwarded-For/Proto/Host headers, Default: ForwardOff
+	Trusted    []*net.IPNet // trusted clients, Default: trust nobody
+	Via        bool         // add Via header and reject looped requests
+	Pseudonym  string       // received-by of Via header, Default: hostname
+}
+
+// SetDefault check and set default value
+func (cfg *ForwardedConf) SetDefault() {
+	if len(cfg.Pseudonym) == 0 {
+		cfg.Pseudonym, _ = os.Hostname()
+	}
+	if len(cfg.Pseudonym) == 0 {
+		cfg.Pseudonym = "proxy"
+	}
+}
+
+var xForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"}
+
+func clientIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (s *Server) trusted(ip net.IP) bool {
+	for _, n := range s.cfg.Forwarded.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func viaProtocol(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d", major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+// looped check our own pseudonym in Via header
+func (s *Server) looped(req *http.Request) bool {
+	if !s.cfg.Forwarded.Via {
+		return false
+	}
+	for _, v := range req.Header["Via"] {
+		for _, hop := range strings.Split(v, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], s.cfg.Forwarded.Pseudonym) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVia append received protocol and our pseudonym to Via header
+func (s *Server) addVia(h http.Header, major, minor int) {
+	if s.cfg.Forwarded.Via {
+		h.Add("Via", viaProtocol(major, minor)+" "+s.cfg.Forwarded.Pseudonym)
+	}
+}
+
+// forwardedFor node of Forwarded header, ipv6 must be quoted
+func forwardedFor(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// quoteString quoted-string of Forwarded header value, RFC 7230 section 3.2.6
+func quoteString(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+func dropIncoming(mode ForwardMode, trusted bool) bool {
+	switch mode {
+	case ForwardReplace, ForwardStrip:
+		return true
+	case ForwardAppend:
+		return !trusted
+	}
+	return false
+}
+
+// setForwarded handle Forwarded and X-Forwarded-* headers of out request,
+// req is the incoming request
+func (s *Server) setForwarded(out, req *http.Request) {
+	ip := clientIP(req.RemoteAddr)
+	trusted := s.trusted(ip)
+	proto := out.URL.Scheme
+	if len(proto) == 0 {
+		proto = "http"
+	}
+	mode := s.cfg.Forwarded.Forwarded
+	if dropIncoming(mode, trusted) {
+		out.Header.Del("Forwarded")
+	}
+	if mode == ForwardAppend || mode == ForwardReplace {
+		value := "for=" + forwardedFor(ip) + ";proto=" + proto
+		if len(req.Host) > 0 {
+			value += ";host=" + quoteString(req.Host)
+		}
+		out.Header.Add("Forwarded", value)
+	}
+	mode = s.cfg.Forwarded.XForwarded
+	if dropIncoming(mode, trusted) {
+		for _, k := range xForwardedHeaders {
+			out.Header.Del(k)
+		}
+	}
+	if mode == ForwardAppend || mode == ForwardReplace {
+		if ip != nil {
+			if prior := out.Header.Get("X-Forwarded-For"); len(prior) > 0 {
+				out.Header.Set("X-Forwarded-For", prior+", "+ip.String())
+			} else {
+				out.Header.Set("X-Forwarded-For", ip.String())
+			}
+		}
+		if len(out.Header.Get("X-Forwarded-Proto")) == 0 {
+			out.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if len(out.Header.Get("X-Forwarded-Host")) == 0 && len(req.Host) > 0 {
+			out.Header.Set("X-Forwarded-Host", req.Host)
+		}
+	}
+	s.addVia(out.Header, req.ProtoMajor, req.ProtoMinor)
+}
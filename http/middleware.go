@@ -0,0 +1,67 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RequestHook modify request before forward, the url, header and body can
+// be rewritten, return non-nil response to reply client without forwarding
+type RequestHook func(req *http.Request) (*http.Response, error)
+
+// ResponseHook modify response before reply client, the body can be
+// wrapped by a reader to modify streamed data
+type ResponseHook func(rep *http.Response) error
+
+// ChainRequest compose request hooks in order
+func ChainRequest(hooks ...RequestHook) RequestHook {
+	return func(req *http.Request) (*http.Response, error) {
+		for _, hook := range hooks {
+			rep, err := hook(req)
+			if err != nil || rep != nil {
+				return rep, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// ChainResponse compose response hooks in order
+func ChainResponse(hooks ...ResponseHook) ResponseHook {
+	return func(rep *http.Response) error {
+		for _, hook := range hooks {
+			if err := hook(rep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// do run request hooks, round trip and response hooks
+func (s *Server) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	rep, err := ChainRequest(s.cfg.RequestHooks...)(req)
+	if err != nil {
+		return nil, fmt.Errorf("request hook: %v", err)
+	}
+	if rep == nil {
+		rep, err = rt.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	} else if rep.Request == nil {
+		rep.Request = req
+	}
+	if rep.Header == nil {
+		rep.Header = make(http.Header)
+	}
+	if rep.Body == nil {
+		rep.Body = http.NoBody
+	}
+	err = ChainResponse(s.cfg.ResponseHooks...)(rep)
+	if err != nil {
+		rep.Body.Close()
+		return nil, fmt.Errorf("response hook: %v", err)
+	}
+	return rep, nil
+}
@@ -0,0 +1,248 @@
+package http
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+)
+
+// MITMConf tls interception config
+type MITMConf struct {
+	CACrt     string   // ca certificate file for signing leaf certificates
+	CAKey     string   // ca private key file
+	CacheSize int      // Default: 1024, leaf certificates in lru cache
+	Bypass    []string // domain suffix or ip tunneled without interception
+	// IdleTimeout close decrypted connection after idle, Default: 90s
+	IdleTimeout time.Duration
+	// InsecureSkipVerify skip verify certificate of origin server
+	InsecureSkipVerify bool
+}
+
+// SetDefault check and set default value
+func (cfg *MITMConf) SetDefault() {
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 1024
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 90 * time.Second
+	}
+}
+
+type certEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+type mitm struct {
+	cfg   MITMConf
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey // shared by all leaf certificates
+
+	mu    sync.Mutex
+	lru   *list.List
+	certs map[string]*list.Element
+}
+
+func newMITM(cfg MITMConf) (*mitm, error) {
+	cfg.SetDefault()
+	pair, err := tls.LoadX509KeyPair(cfg.CACrt, cfg.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, errors.New("mitm certificate is not a ca")
+	}
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported mitm ca private key")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &mitm{
+		cfg:   cfg,
+		ca:    ca,
+		caKey: caKey,
+		key:   key,
+		lru:   list.New(),
+		certs: make(map[string]*list.Element),
+	}, nil
+}
+
+func (m *mitm) bypass(a addr.Addr) bool {
+	host := a.Domain
+	if a.Type != addr.Domain {
+		host = a.IP.String()
+	}
+	host = strings.ToLower(host)
+	for _, suffix := range m.cfg.Bypass {
+		suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddr compare host and port, domain is case insensitive
+func sameAddr(x, y addr.Addr) bool {
+	if x.Port != y.Port {
+		return false
+	}
+	if x.Type == addr.Domain || y.Type == addr.Domain {
+		return x.Type == y.Type && strings.EqualFold(x.Domain, y.Domain)
+	}
+	return x.IP.Equal(y.IP)
+}
+
+// certificate get leaf certificate from cache or sign a new one
+func (m *mitm) certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	m.mu.Lock()
+	if e, ok := m.certs[host]; ok {
+		m.lru.MoveToFront(e)
+		cert := e.Value.(certEntry).cert
+		m.mu.Unlock()
+		return cert, nil
+	}
+	m.mu.Unlock()
+
+	cert, err := m.sign(host)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.certs[host]; ok {
+		m.lru.MoveToFront(e)
+		return e.Value.(certEntry).cert, nil
+	}
+	m.certs[host] = m.lru.PushFront(certEntry{host: host, cert: cert})
+	for m.lru.Len() > m.cfg.CacheSize {
+		e := m.lru.Back()
+		m.lru.Remove(e)
+		delete(m.certs, e.Value.(certEntry).host)
+	}
+	return cert, nil
+}
+
+func (m *mitm) sign(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.AddDate(1, 0, 0)
+	if notAfter.After(m.ca.NotAfter) {
+		notAfter = m.ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, m.key.Public(), m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  m.key,
+	}, nil
+}
+
+// serveMITM terminate tls of CONNECT tunnel and forward decrypted requests
+func (s *Server) serveMITM(w http.ResponseWriter, req *http.Request, user string, a addr.Addr) {
+	conn, err := s.tunnel(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	host := a.Domain
+	if a.Type != addr.Domain {
+		host = a.IP.String()
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if len(name) == 0 {
+				name = host
+			}
+			return s.mitm.certificate(name)
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	// deadlines of client connection were cleared by hijack
+	tlsConn.SetDeadline(time.Now().Add(s.cfg.ReadTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		s.cfg.Handler.LogDebug("mitm handshake failed" + errInfo(req.RemoteAddr, err))
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	tr := s.newTransport(req.RemoteAddr, user, &tls.Config{
+		InsecureSkipVerify: s.mitm.cfg.InsecureSkipVerify,
+	})
+	defer tr.CloseIdleConnections()
+	done := make(chan struct{})
+	var once sync.Once
+	svr := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// bypass and leaf certificate were chosen by CONNECT authority
+			if len(r.Host) > 0 && !sameAddr(parseAddr(r.Host, 443), a) {
+				s.cfg.Handler.LogError("mitm host %s mismatch %s, addr=%s", r.Host, a.String(), req.RemoteAddr)
+				http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+				return
+			}
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if len(r.URL.Host) == 0 {
+				r.URL.Host = a.String()
+			}
+			s.roundTrip(w, r, tr)
+		}),
+		ReadHeaderTimeout: s.cfg.ReadTimeout,
+		IdleTimeout:       s.mitm.cfg.IdleTimeout,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() {
+					close(done)
+				})
+			}
+		},
+		ErrorLog: log.New(logWriter(s.cfg.Handler.LogDebug), "[MITM]", 0),
+	}
+	go svr.Serve(&connListener{conn: tlsConn})
+	<-done
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PACAction action of pac rule
+type PACAction int
+
+const (
+	// PACProxy connect by this http proxy
+	PACProxy PACAction = iota
+	// PACDirect connect directly
+	PACDirect
+	// PACSocks connect by socks5 proxy of PACConf.Socks
+	PACSocks
+)
+
+// PACRule routing rule of pac file
+type PACRule struct {
+	Domain  []string     // match host by domain suffix
+	Network []*net.IPNet // match resolved host ip
+	Action  PACAction
+}
+
+// PACConf pac file config, served on /proxy.pac and /wpad.dat
+type PACConf struct {
+	Host    string    // advertised proxy host:port, Default: Host of pac request
+	Socks   string    // advertised socks5 proxy host:port used by PACSocks rules
+	HTTPS   bool      // advertise proxy as HTTPS
+	Rules   []PACRule // first matched rule is used
+	Default PACAction // Default: PACProxy
+}
+
+func matchDomain(host, suffix string) bool {
+	suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// resolveIPv4 resolve host to ipv4 address like dnsResolve of pac script
+func resolveIPv4(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Action get action of host by rules, host is resolved when ip networks
+// are checked, so handlers apply the same rule set as the pac file
+func (cfg PACConf) Action(host string) PACAction {
+	host = strings.ToLower(host)
+	var ip net.IP
+	resolved := false
+	for _, r := range cfg.Rules {
+		for _, suffix := range r.Domain {
+			if matchDomain(host, suffix) {
+				return r.Action
+			}
+		}
+		if len(r.Network) > 0 && !resolved {
+			ip = resolveIPv4(host)
+			resolved = true
+		}
+		for _, n := range r.Network {
+			if ip != nil && n.Contains(ip) {
+				return r.Action
+			}
+		}
+	}
+	return cfg.Default
+}
+
+func (cfg PACConf) result(action PACAction, host string) string {
+	switch action {
+	case PACDirect:
+		return "DIRECT"
+	case PACSocks:
+		return fmt.Sprintf("SOCKS5 %s; SOCKS %s", cfg.Socks, cfg.Socks)
+	}
+	if cfg.HTTPS {
+		return "HTTPS " + host
+	}
+	return "PROXY " + host
+}
+
+// Script generate pac script, host is advertised proxy host:port
+func (cfg PACConf) Script(host string) string {
+	if len(cfg.Host) > 0 {
+		host = cfg.Host
+	}
+	var buf strings.Builder
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("  host = host.toLowerCase();\n")
+	resolved := false
+	for _, r := range cfg.Rules {
+		var conds []string
+		for _, suffix := range r.Domain {
+			suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+			conds = append(conds, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", suffix, "."+suffix))
+		}
+		for _, n := range r.Network {
+			if !resolved {
+				buf.WriteString("  var ip = dnsResolve(host);\n")
+				resolved = true
+			}
+			if n.IP.To4() != nil {
+				conds = append(conds, fmt.Sprintf("(ip && isInNet(ip, %q, %q))",
+					n.IP.String(), net.IP(n.Mask).String()))
+			} else {
+				conds = append(conds, fmt.Sprintf(`(ip && typeof isInNetEx == "function" && isInNetEx(ip, %q))`,
+					n.String()))
+			}
+		}
+		if len(conds) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "  if (%s) return %q;\n", strings.Join(conds, " || "), cfg.result(r.Action, host))
+	}
+	fmt.Fprintf(&buf, "  return %q;\n", cfg.result(cfg.Default, host))
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// isPAC check origin-form request of pac file to the proxy itself
+func (s *Server) isPAC(req *http.Request) bool {
+	if s.cfg.PAC == nil || req.ProtoMajor >= 2 || len(req.URL.Host) > 0 {
+		return false
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.URL.Path == "/proxy.pac" || req.URL.Path == "/wpad.dat"
+}
+
+func (s *Server) servePAC(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method == http.MethodHead {
+		return
+	}
+	w.Write([]byte(s.cfg.PAC.Script(req.Host)))
+}
@@ -3,16 +3,21 @@ package http
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"strconv"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/auth"
+	"github.com/lwch/proxy/http/cache"
+	"github.com/lwch/proxy/outbound"
+	"github.com/lwch/proxy/proxyproto"
 )
 
 // ServerHandler server handler
@@ -25,6 +30,20 @@ type ServerHandler interface {
 	Forward(local, remote io.ReadWriteCloser)
 }
 
+// UserHandler optional interface of ServerHandler, when implemented
+// ConnectUser is called instead of Connect with the authenticated user
+type UserHandler interface {
+	ConnectUser(from, user string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
+// CacheHandler optional interface of ServerHandler, CheckCache is called
+// before a response stored in ServerConf.Cache is served, since Connect
+// and Forward are not called for it, return error to reject the request,
+// the cache is not used when custom handler not implemented
+type CacheHandler interface {
+	CheckCache(from, user string, to addr.Addr) error
+}
+
 // ServerConf server config
 type ServerConf struct {
 	ReadTimeout  time.Duration // Default: 1s
@@ -33,6 +52,40 @@ type ServerConf struct {
 	Key          string
 	Crt          string
 	Handler      ServerHandler
+	Outbound     outbound.Conf // used by default handler
+	// CheckUserPass check user/pass when Check is set, e.g. Check of
+	// auth.Htpasswd, Default: ServerHandler.CheckUserPass
+	CheckUserPass func(user, pass string) bool
+	// CheckUserPassFrom used instead of CheckUserPass when set, from is
+	// client address
+	CheckUserPassFrom func(from, user, pass string) bool
+	// Guard reject banned clients and users, failures are replied after
+	// backoff delay, Default: nil disabled
+	Guard *auth.Guard
+	// ProxyProtocol accept proxy protocol header from trusted sources,
+	// Default: nil disabled
+	ProxyProtocol *proxyproto.Conf
+	// MITM intercept tls of CONNECT tunnels, Default: nil disabled
+	MITM *MITMConf
+	// RequestHooks called in order before forward plain http and
+	// decrypted requests
+	RequestHooks []RequestHook
+	// ResponseHooks called in order before reply client
+	ResponseHooks []ResponseHook
+	// Forwarded Forwarded, X-Forwarded-* and Via headers of forwarded requests
+	Forwarded ForwardedConf
+	// UDPTemplate uri template of connect-udp requests, e.g.
+	// DefaultUDPTemplate, HTTP/2 extended CONNECT requires
+	// GODEBUG=http2xconnect=1, Default: empty disabled
+	UDPTemplate string
+	// PAC serve pac file on /proxy.pac and /wpad.dat, Default: nil disabled
+	PAC *PACConf
+	// Cache shared cache of plain http responses, custom handler must
+	// implement CacheHandler to use it, Default: nil disabled
+	Cache *cache.Cache
+	// ClientCert authenticate tls clients by certificate, user/pass is
+	// not checked for verified certificates, Default: nil disabled
+	ClientCert *ClientCertConf
 }
 
 // SetDefault check and set default value
@@ -44,21 +97,44 @@ func (cfg *ServerConf) SetDefault() {
 		cfg.WriteTimeout = time.Second
 	}
 	if cfg.Handler == nil {
-		cfg.Handler = defaultServerHandler{}
+		cfg.Handler = defaultServerHandler{out: outbound.New(cfg.Outbound)}
+	}
+	if cfg.CheckUserPass == nil {
+		cfg.CheckUserPass = cfg.Handler.CheckUserPass
 	}
+	if cfg.CheckUserPassFrom == nil {
+		check := cfg.CheckUserPass
+		cfg.CheckUserPassFrom = func(from, user, pass string) bool {
+			return check(user, pass)
+		}
+	}
+	if cfg.Guard != nil {
+		cfg.CheckUserPassFrom = cfg.Guard.Wrap(cfg.CheckUserPassFrom)
+	}
+	cfg.Forwarded.SetDefault()
 }
 
 // Server socks5 server
 type Server struct {
-	cfg ServerConf
-	svr *http.Server
+	cfg         ServerConf
+	svr         *http.Server
+	out         *outbound.Dialer
+	mitm        *mitm
+	clientCert  *clientCert
+	udpTemplate *regexp.Regexp
+	initErr     error
+
+	// transports of client connections
+	mu         sync.Mutex
+	transports map[string]*clientTransport
 }
 
 // NewServer create server
 func NewServer(cfg ServerConf, addr string) *Server {
 	cfg.SetDefault()
 	svr := &Server{
-		cfg: cfg,
+		cfg:        cfg,
+		transports: make(map[string]*clientTransport),
 		svr: &http.Server{
 			ReadTimeout:  cfg.ReadTimeout,
 			WriteTimeout: cfg.WriteTimeout,
@@ -66,6 +142,23 @@ func NewServer(cfg ServerConf, addr string) *Server {
 		},
 	}
 	svr.svr.Handler = svr
+	svr.svr.ConnState = svr.connState
+	svr.out = outbound.New(cfg.Outbound)
+	if len(cfg.UDPTemplate) > 0 {
+		svr.udpTemplate, svr.initErr = compileTemplate(cfg.UDPTemplate)
+	}
+	if svr.initErr == nil && cfg.MITM != nil {
+		svr.mitm, svr.initErr = newMITM(*cfg.MITM)
+		if svr.initErr != nil {
+			svr.initErr = fmt.Errorf("load mitm ca: %v", svr.initErr)
+		}
+	}
+	if svr.initErr == nil && cfg.ClientCert != nil {
+		svr.clientCert, svr.svr.TLSConfig, svr.initErr = newClientCert(*cfg.ClientCert)
+		if svr.initErr != nil {
+			svr.initErr = fmt.Errorf("load client ca: %v", svr.initErr)
+		}
+	}
 	return svr
 }
 
@@ -74,14 +167,36 @@ func (s *Server) Shutdown() {
 	s.svr.Shutdown(context.Background())
 }
 
+func (s *Server) listen() (net.Listener, error) {
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	l, err := net.Listen("tcp", s.svr.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.ProxyProtocol != nil {
+		l = proxyproto.NewListener(l, *s.cfg.ProxyProtocol)
+	}
+	return l, nil
+}
+
 // ListenAndServe listen and serve
 func (s *Server) ListenAndServe() error {
-	return s.svr.ListenAndServe()
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.svr.Serve(l)
 }
 
 // ListenAndServeTLS listen and serve tls
 func (s *Server) ListenAndServeTLS() error {
-	return s.svr.ListenAndServeTLS(s.cfg.Crt, s.cfg.Key)
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.svr.ServeTLS(l, s.cfg.Crt, s.cfg.Key)
 }
 
 // copy from req.BasicAuth
@@ -104,91 +219,136 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if s.cfg.Check {
+	if s.isPAC(req) {
+		s.servePAC(w, req)
+		return
+	}
+	user, verified, err := s.certUser(req)
+	if err != nil {
+		s.cfg.Handler.LogError("map client certificate failed" + errInfo(req.RemoteAddr, err))
+		http.Error(w, "invalid client certificate", http.StatusForbidden)
+		return
+	}
+	if s.cfg.Check && !verified {
+		if s.cfg.Guard != nil && s.cfg.Guard.Check(req.RemoteAddr, "") != nil {
+			s.cfg.Handler.LogError("client banned, addr=%s", req.RemoteAddr)
+			http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
+			return
+		}
 		// https://www.ietf.org/rfc/rfc2068.txt 14.33
-		auth := req.Header.Get("Proxy-Authenticate")
+		auth := req.Header.Get("Proxy-Authorization")
+		if len(auth) == 0 {
+			// compatible with old clients
+			auth = req.Header.Get("Proxy-Authenticate")
+		}
 		if len(auth) == 0 {
 			http.Error(w, "forbidden", http.StatusProxyAuthRequired)
 			return
 		}
-		user, pass, ok := parseBasicAuth(auth)
+		var pass string
+		var ok bool
+		user, pass, ok = parseBasicAuth(auth)
 		if !ok {
 			http.Error(w, "forbidden", http.StatusProxyAuthRequired)
 			return
 		}
-		if !s.cfg.Handler.CheckUserPass(user, pass) {
+		if s.cfg.Guard != nil {
+			// failure is replied after backoff delay
+			http.NewResponseController(w).SetWriteDeadline(
+				time.Now().Add(s.cfg.WriteTimeout + s.cfg.Guard.MaxDelay()))
+		}
+		if !s.cfg.CheckUserPassFrom(req.RemoteAddr, user, pass) {
+			s.cfg.Handler.LogError("invalid user/pass, user=%s, addr=%s", user, req.RemoteAddr)
 			http.Error(w, "invalid user/pass", http.StatusUnauthorized)
 			return
 		}
 	}
-	// fix DumpRequest missing Host header
-	req.RequestURI = ""
 	req.Header.Del("Proxy-Authenticate")
-	host, port, err := net.SplitHostPort(req.Host)
-	if err != nil {
-		host = req.Host
-	}
-	var a addr.Addr
-	if ip := net.ParseIP(host); ip == nil {
-		a.Type = addr.Domain
-		a.Domain = host
-	} else if len(ip) == net.IPv4len {
-		a.Type = addr.IPV4
-		a.IP = ip
-	} else {
-		a.Type = addr.IPV6
-		a.IP = ip
-	}
-	n, err := strconv.ParseUint(port, 10, 16)
-	if err == nil {
-		a.Port = uint16(n)
-	}
-	if a.Port == 0 {
-		if req.Method == http.MethodConnect {
-			a.Port = 443
-		} else {
-			a.Port = 80
+	req.Header.Del("Proxy-Authorization")
+	if s.looped(req) {
+		s.cfg.Handler.LogError("loop detected, addr=%s, via=%s", req.RemoteAddr, req.Header.Get("Via"))
+		http.Error(w, "loop detected", http.StatusLoopDetected)
+		return
+	}
+	if isConnectUDP(req) {
+		if s.udpTemplate == nil {
+			http.Error(w, "connect-udp disabled", http.StatusNotImplemented)
+			return
 		}
+		s.serveUDP(w, req, user)
+		return
+	}
+	if req.Method != http.MethodConnect {
+		if len(req.URL.Host) == 0 {
+			req.URL.Host = req.Host
+		}
+		if len(req.URL.Scheme) == 0 {
+			req.URL.Scheme = "http"
+		}
+		var rt http.RoundTripper = s.transport(req.RemoteAddr, user)
+		if s.cfg.Cache != nil && len(upgradeType(req.Header)) == 0 {
+			rt = s.cacheTransport(rt, req.RemoteAddr, user)
+		}
+		s.roundTrip(w, req, rt)
+		return
+	}
+	a := parseAddr(req.Host, 443)
+	if s.mitm != nil && !s.mitm.bypass(a) {
+		s.serveMITM(w, req, user, a)
+		return
 	}
-	remote, _, err := s.cfg.Handler.Connect(req.RemoteAddr, a)
+	remote, _, err := s.connect(req.RemoteAddr, user, a)
 	if err != nil {
 		s.cfg.Handler.LogError("connect %s failed"+errInfo(req.RemoteAddr, err), a.String())
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	defer remote.Close()
+	conn, err := s.tunnel(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.cfg.Handler.Forward(conn, remote)
+}
+
+// tunnel take over client connection of CONNECT request after reply 200,
+// HTTP/2 streams are tunneled by request body and flushed response writer
+func (s *Server) tunnel(w http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if req.ProtoMajor >= 2 {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		w.WriteHeader(http.StatusOK)
+		err := rc.Flush()
+		if err != nil {
+			s.cfg.Handler.LogError("reply stream failed" + errInfo(req.RemoteAddr, err))
+			return nil, err
+		}
+		return newStreamConn(w, req), nil
+	}
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		s.cfg.Handler.LogError("not supported hijacker, addr=%s", req.RemoteAddr)
 		http.Error(w, "not supported hijacker", http.StatusBadRequest)
-		return
+		return nil, errors.New("not supported hijacker")
 	}
-	conn, _, err := hijacker.Hijack()
+	conn, brw, err := hijacker.Hijack()
 	if err != nil {
 		s.cfg.Handler.LogError("hijack failed" + errInfo(req.RemoteAddr, err))
 		http.Error(w, fmt.Sprintf("hijack: %s", err.Error()), http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	if req.Method == http.MethodConnect {
-		err = replyOK(conn)
-		if err != nil {
-			s.cfg.Handler.LogError("replyOK failed" + errInfo(req.RemoteAddr, err))
-			return
-		}
-	} else {
-		data, err := httputil.DumpRequest(req, true)
-		if err != nil {
-			s.cfg.Handler.LogError("dump request failed" + errInfo(req.RemoteAddr, err))
-			http.Error(w, fmt.Sprintf("dump request: %s", err.Error()), http.StatusBadRequest)
-			return
-		}
-		_, err = remote.Write(data)
-		if err != nil {
-			s.cfg.Handler.LogError("forward request failed" + errInfo(req.RemoteAddr, err))
-			http.Error(w, fmt.Sprintf("forward: %s", err.Error()), http.StatusBadGateway)
-			return
-		}
+	err = replyOK(conn)
+	if err != nil {
+		s.cfg.Handler.LogError("replyOK failed" + errInfo(req.RemoteAddr, err))
+		conn.Close()
+		return nil, err
 	}
-	s.cfg.Handler.Forward(conn, remote)
+	if brw.Reader.Buffered() > 0 {
+		return bufConn{Conn: conn, r: brw.Reader}, nil
+	}
+	return conn, nil
 }
 
 func replyOK(w net.Conn) error {
@@ -201,3 +361,24 @@ func replyOK(w net.Conn) error {
 	}
 	return resp.Write(w)
 }
+
+// cacheTransport wrap rt by cache, stored responses are served after
+// checked by CacheHandler, acl of custom handler must not be bypassed
+func (s *Server) cacheTransport(rt http.RoundTripper, from, user string) http.RoundTripper {
+	if h, ok := s.cfg.Handler.(CacheHandler); ok {
+		return s.cfg.Cache.CheckTransport(rt, func(req *http.Request) error {
+			return h.CheckCache(from, user, parseAddr(req.URL.Host, 80))
+		})
+	}
+	if _, ok := s.cfg.Handler.(defaultServerHandler); ok {
+		return s.cfg.Cache.Transport(rt)
+	}
+	return rt
+}
+
+func (s *Server) connect(from, user string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	if h, ok := s.cfg.Handler.(UserHandler); ok {
+		return h.ConnectUser(from, user, to)
+	}
+	return s.cfg.Handler.Connect(from, to)
+}
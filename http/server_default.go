@@ -4,12 +4,14 @@ import (
 	"context"
 	"io"
 	"log"
-	"net"
 
 	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/outbound"
 )
 
-type defaultServerHandler struct{}
+type defaultServerHandler struct {
+	out *outbound.Dialer
+}
 
 func (h defaultServerHandler) LogDebug(format string, a ...interface{}) {
 	log.Printf("[DEBUG]"+format, a...)
@@ -28,19 +30,11 @@ func (h defaultServerHandler) CheckUserPass(user, pass string) bool {
 }
 
 func (h defaultServerHandler) Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
-	var remote *net.TCPConn
-	var err error
-	switch to.Type {
-	case addr.IPV4, addr.IPV6:
-		remote, err = net.DialTCP("tcp", nil, &net.TCPAddr{IP: to.IP, Port: int(to.Port)})
-	case addr.Domain:
-		var addr *net.TCPAddr
-		addr, err = net.ResolveTCPAddr("tcp", to.String())
-		if err != nil {
-			return nil, to, err
-		}
-		remote, err = net.DialTCP("tcp", nil, addr)
-	}
+	return h.ConnectUser(from, "", to)
+}
+
+func (h defaultServerHandler) ConnectUser(from, user string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	remote, err := h.out.Dial(from, user, to)
 	if err != nil {
 		return nil, to, err
 	}
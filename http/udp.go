@@ -0,0 +1,162 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+)
+
+// DefaultUDPTemplate default uri template of connect-udp, RFC 9298
+const DefaultUDPTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+// UDPHandler optional interface of ServerHandler, ConnectUDP is used for
+// connect-udp requests and the returned connection must keep message
+// boundaries, connect-udp is refused when custom handler not implemented
+type UDPHandler interface {
+	ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
+// compileTemplate compile uri template to regexp with host and port groups
+func compileTemplate(t string) (*regexp.Regexp, error) {
+	if !strings.Contains(t, "{target_host}") || !strings.Contains(t, "{target_port}") {
+		return nil, fmt.Errorf("invalid udp template: %s", t)
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for len(t) > 0 {
+		idx := strings.IndexByte(t, '{')
+		if idx < 0 {
+			expr.WriteString(regexp.QuoteMeta(t))
+			break
+		}
+		expr.WriteString(regexp.QuoteMeta(t[:idx]))
+		t = t[idx:]
+		end := strings.IndexByte(t, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid udp template: %s", t)
+		}
+		switch t[1:end] {
+		case "target_host":
+			expr.WriteString("(?P<host>[^/?&]+)")
+		case "target_port":
+			expr.WriteString("(?P<port>[^/?&]+)")
+		default:
+			return nil, fmt.Errorf("unsupported udp template variable: %s", t[:end+1])
+		}
+		t = t[end+1:]
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// isConnectUDP check HTTP/1.1 upgrade or HTTP/2 extended CONNECT of connect-udp,
+// HTTP/1.1 requests must be origin-form to the proxy itself
+func isConnectUDP(req *http.Request) bool {
+	if req.ProtoMajor >= 2 {
+		return req.Method == http.MethodConnect && req.Header.Get(":protocol") == "connect-udp"
+	}
+	return req.Method == http.MethodGet && len(req.URL.Host) == 0 &&
+		strings.EqualFold(upgradeType(req.Header), "connect-udp")
+}
+
+// udpTarget parse target address from request uri by template
+func (s *Server) udpTarget(req *http.Request) (addr.Addr, error) {
+	target := addr.Addr{Type: addr.Unknown}
+	uri := req.URL.EscapedPath()
+	if strings.Contains(s.cfg.UDPTemplate, "?") {
+		uri += "?" + req.URL.RawQuery
+	}
+	m := s.udpTemplate.FindStringSubmatch(uri)
+	if m == nil {
+		return target, fmt.Errorf("uri %s not match template", uri)
+	}
+	host, err := url.PathUnescape(m[s.udpTemplate.SubexpIndex("host")])
+	if err != nil {
+		return target, fmt.Errorf("invalid target_host: %v", err)
+	}
+	port, err := strconv.ParseUint(m[s.udpTemplate.SubexpIndex("port")], 10, 16)
+	if err != nil || port == 0 {
+		return target, fmt.Errorf("invalid target_port: %s", m[s.udpTemplate.SubexpIndex("port")])
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr.FromIP(ip, uint16(port)), nil
+	}
+	return addr.Addr{Type: addr.Domain, Domain: host, Port: uint16(port)}, nil
+}
+
+func (s *Server) connectUDP(from, user string, to addr.Addr) (io.ReadWriteCloser, error) {
+	if h, ok := s.cfg.Handler.(UDPHandler); ok {
+		remote, _, err := h.ConnectUDP(from, to)
+		return remote, err
+	}
+	// udp must not bypass Connect of custom handler
+	if _, ok := s.cfg.Handler.(defaultServerHandler); !ok {
+		return nil, errors.New("udp not supported by handler")
+	}
+	return s.out.DialUDP(from, user, to)
+}
+
+// serveUDP relay datagrams of connect-udp request, RFC 9298
+func (s *Server) serveUDP(w http.ResponseWriter, req *http.Request, user string) {
+	to, err := s.udpTarget(req)
+	if err != nil {
+		s.cfg.Handler.LogError("connect-udp failed" + errInfo(req.RemoteAddr, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remote, err := s.connectUDP(req.RemoteAddr, user, to)
+	if err != nil {
+		s.cfg.Handler.LogError("connect udp %s failed"+errInfo(req.RemoteAddr, err), to.String())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	var local io.ReadWriteCloser
+	if req.ProtoMajor >= 2 {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		err = rc.Flush()
+		if err != nil {
+			s.cfg.Handler.LogError("reply connect-udp failed" + errInfo(req.RemoteAddr, err))
+			return
+		}
+		stream := newStreamConn(w, req)
+		local = newCapsuleConn(stream, stream, stream)
+	} else {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			s.cfg.Handler.LogError("not supported hijacker, addr=%s", req.RemoteAddr)
+			http.Error(w, "not supported hijacker", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := hijacker.Hijack()
+		if err != nil {
+			s.cfg.Handler.LogError("hijack failed" + errInfo(req.RemoteAddr, err))
+			http.Error(w, fmt.Sprintf("hijack: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+		err = brw.Flush()
+		if err != nil {
+			s.cfg.Handler.LogError("reply connect-udp failed" + errInfo(req.RemoteAddr, err))
+			conn.Close()
+			return
+		}
+		local = newCapsuleConn(brw.Reader, conn, conn)
+	}
+	defer local.Close()
+	s.cfg.Handler.Forward(local, remote)
+}
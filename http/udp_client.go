@@ -0,0 +1,138 @@
+package http
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UDPClientConf connect-udp client config
+type UDPClientConf struct {
+	ServerAddr   string        // Default: 127.0.0.1:1080
+	TLS          *tls.Config   // Default: nil, connect server without tls
+	Template     string        // Default: DefaultUDPTemplate
+	User         string        // proxy user, empty is no authentication
+	Pass         string        // proxy password
+	ReadTimeout  time.Duration // Default: 1s
+	WriteTimeout time.Duration // Default: 1s
+}
+
+// SetDefault check and set default value
+func (cfg *UDPClientConf) SetDefault() {
+	if len(cfg.ServerAddr) == 0 {
+		cfg.ServerAddr = "127.0.0.1:1080"
+	}
+	if len(cfg.Template) == 0 {
+		cfg.Template = DefaultUDPTemplate
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = time.Second
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = time.Second
+	}
+}
+
+// UDPClient connect-udp client over HTTP/1.1 upgrade, RFC 9298
+type UDPClient struct {
+	cfg UDPClientConf
+}
+
+// NewUDPClient create client
+func NewUDPClient(cfg UDPClientConf) (*UDPClient, error) {
+	cfg.SetDefault()
+	if _, err := compileTemplate(cfg.Template); err != nil {
+		return nil, err
+	}
+	return &UDPClient{cfg: cfg}, nil
+}
+
+// expand expand uri template by target host and port
+func (c *UDPClient) expand(host, port string) string {
+	escape := url.PathEscape
+	if idx := strings.IndexByte(c.cfg.Template, '?'); idx >= 0 &&
+		idx < strings.Index(c.cfg.Template, "{target_host}") {
+		escape = url.QueryEscape
+	}
+	host = strings.ReplaceAll(escape(host), ":", "%3A")
+	uri := strings.ReplaceAll(c.cfg.Template, "{target_host}", host)
+	return strings.ReplaceAll(uri, "{target_port}", escape(port))
+}
+
+// Dial dial udp address by proxy, each Read and Write of the returned
+// connection is one datagram
+func (c *UDPClient) Dial(address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("split host:port: %v", err)
+	}
+	var conn net.Conn
+	if c.cfg.TLS != nil {
+		conn, err = tls.Dial("tcp", c.cfg.ServerAddr, c.cfg.TLS)
+	} else {
+		conn, err = net.Dial("tcp", c.cfg.ServerAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect: %v", err)
+	}
+	req := "GET " + c.expand(host, port) + " HTTP/1.1\r\n" +
+		"Host: " + c.cfg.ServerAddr + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n"
+	if len(c.cfg.User) > 0 {
+		req += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(c.cfg.User+":"+c.cfg.Pass)) + "\r\n"
+	}
+	req += "\r\n"
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	r := bufio.NewReader(conn)
+	rep, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read response: %v", err)
+	}
+	if rep.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("connect-udp: %s", rep.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	var remote net.Addr = dummyAddr(address)
+	if ip := net.ParseIP(host); ip != nil {
+		remote, _ = net.ResolveUDPAddr("udp", address)
+	}
+	return &udpConn{
+		Conn:   conn,
+		cc:     newCapsuleConn(r, conn, conn),
+		remote: remote,
+	}, nil
+}
+
+// udpConn datagram connection of connect-udp
+type udpConn struct {
+	net.Conn
+	cc     *capsuleConn
+	remote net.Addr
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	return c.cc.Read(p)
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	return c.cc.Write(p)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -1,9 +1,170 @@
 package http
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/proxy/addr"
 )
 
 func errInfo(addr string, err error) string {
 	return fmt.Sprintf("; addr=%s, err=%v", addr, err)
 }
+
+// parseAddr parse host[:port] to address
+func parseAddr(hostport string, defaultPort uint16) addr.Addr {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	var a addr.Addr
+	if ip := net.ParseIP(host); ip == nil {
+		a.Type = addr.Domain
+		a.Domain = host
+	} else {
+		a = addr.FromIP(ip, 0)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err == nil {
+		a.Port = uint16(n)
+	}
+	if a.Port == 0 {
+		a.Port = defaultPort
+	}
+	return a
+}
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
+
+// rwConn net.Conn wrapper of io.ReadWriteCloser returned by handler
+type rwConn struct {
+	io.ReadWriteCloser
+}
+
+func (c rwConn) LocalAddr() net.Addr                { return dummyAddr("local") }
+func (c rwConn) RemoteAddr() net.Addr               { return dummyAddr("remote") }
+func (c rwConn) SetDeadline(t time.Time) error      { return nil }
+func (c rwConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c rwConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func toConn(rwc io.ReadWriteCloser) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+	return rwConn{rwc}
+}
+
+// bufConn connection read buffered data first
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener listener accept only one connection
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn == nil {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// logWriter write log by handler
+type logWriter func(format string, a ...interface{})
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// streamConn net.Conn of HTTP/2 CONNECT stream, RFC 7540 section 8.3,
+// it must be closed before handler returned
+type streamConn struct {
+	r      io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+
+	// response writer panics when written after handler finished
+	mu     sync.Mutex
+	closed bool
+}
+
+func newStreamConn(w http.ResponseWriter, req *http.Request) *streamConn {
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = dummyAddr("local")
+	}
+	return &streamConn{
+		r:      req.Body,
+		w:      w,
+		rc:     http.NewResponseController(w),
+		local:  local,
+		remote: dummyAddr(req.RemoteAddr),
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close close stream, writes after closed return error
+func (c *streamConn) Close() error {
+	// unblock pending write before waiting for it
+	c.rc.SetWriteDeadline(time.Now())
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.r.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
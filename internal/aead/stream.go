@@ -0,0 +1,186 @@
+// Package aead chunk stream shared by shadowsocks and socks5 psk layer
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxPayload max payload size of one chunk
+const MaxPayload = 0x3fff
+
+// ErrReplay salt of reading direction was seen before
+var ErrReplay = errors.New("replayed salt")
+
+// NewFunc create aead of one direction by salt
+type NewFunc func(salt []byte) (cipher.AEAD, error)
+
+// Conn tcp stream of aead chunks, each direction starts with random salt
+// followed by sealed length and payload chunks
+type Conn struct {
+	net.Conn
+	saltSize int
+	newR     NewFunc
+	newW     NewFunc
+	filter   *SaltFilter // check salt replay of reading direction
+
+	rmu    sync.Mutex
+	r      cipher.AEAD
+	rnonce []byte
+	rbuf   []byte // decrypted data not read
+
+	wmu    sync.Mutex
+	w      cipher.AEAD
+	wnonce []byte
+}
+
+// NewConn create stream, newR and newW create aead of reading and writing
+// direction, filter is optional
+func NewConn(c net.Conn, saltSize int, newR, newW NewFunc, filter *SaltFilter) *Conn {
+	return &Conn{
+		Conn:     c,
+		saltSize: saltSize,
+		newR:     newR,
+		newW:     newW,
+		filter:   filter,
+	}
+}
+
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rbuf) > 0 {
+		n := copy(p, c.rbuf)
+		c.rbuf = c.rbuf[n:]
+		return n, nil
+	}
+	if c.r == nil {
+		salt := make([]byte, c.saltSize)
+		_, err := io.ReadFull(c.Conn, salt)
+		if err != nil {
+			return 0, err
+		}
+		if c.filter != nil && !c.filter.Add(salt) {
+			return 0, ErrReplay
+		}
+		c.r, err = c.newR(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.rnonce = make([]byte, c.r.NonceSize())
+	}
+	hdr := make([]byte, 2+c.r.Overhead())
+	_, err := io.ReadFull(c.Conn, hdr)
+	if err != nil {
+		return 0, err
+	}
+	hdr, err = c.r.Open(hdr[:0], c.rnonce, hdr, nil)
+	if err != nil {
+		return 0, err
+	}
+	incNonce(c.rnonce)
+	size := int(binary.BigEndian.Uint16(hdr)) & MaxPayload
+	buf := make([]byte, size+c.r.Overhead())
+	_, err = io.ReadFull(c.Conn, buf)
+	if err != nil {
+		return 0, err
+	}
+	buf, err = c.r.Open(buf[:0], c.rnonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	incNonce(c.rnonce)
+	n := copy(p, buf)
+	c.rbuf = buf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var buf []byte
+	if c.w == nil {
+		salt := make([]byte, c.saltSize)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.w, err = c.newW(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.wnonce = make([]byte, c.w.NonceSize())
+		buf = salt
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		buf = c.w.Seal(buf, c.wnonce, size[:], nil)
+		incNonce(c.wnonce)
+		buf = c.w.Seal(buf, c.wnonce, p[:n], nil)
+		incNonce(c.wnonce)
+		_, err := c.Conn.Write(buf)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		buf = buf[:0]
+	}
+	return written, nil
+}
+
+// SaltFilter remember recent salts to reject replayed connections, the
+// older generation is dropped when current generation is full
+type SaltFilter struct {
+	mu       sync.Mutex
+	capacity int
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+// NewSaltFilter create filter remember at least capacity salts
+func NewSaltFilter(capacity int) *SaltFilter {
+	return &SaltFilter{
+		capacity: capacity,
+		current:  make(map[string]struct{}),
+	}
+}
+
+// Add add salt, return false when salt exists
+func (f *SaltFilter) Add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := string(salt)
+	if _, ok := f.current[key]; ok {
+		return false
+	}
+	if _, ok := f.previous[key]; ok {
+		return false
+	}
+	if len(f.current) >= f.capacity {
+		f.previous = f.current
+		f.current = make(map[string]struct{})
+	}
+	f.current[key] = struct{}{}
+	return true
+}
@@ -0,0 +1,76 @@
+// Package udpsession udp session of one client shared by udp servers
+package udpsession
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session datagrams of one client, datagrams received by server are pushed
+// to session and replies are sent by write function
+type Session struct {
+	active  int64 // keep 64-bit aligned for atomic
+	write   func(p []byte) (int, error)
+	timeout time.Duration
+	in      chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// New create session closed after idle timeout, write send one datagram
+// to client
+func New(timeout time.Duration, write func(p []byte) (int, error)) *Session {
+	return &Session{
+		write:   write,
+		timeout: timeout,
+		active:  time.Now().UnixNano(),
+		in:      make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Push queue datagram from client
+func (s *Session) Push(data []byte) {
+	select {
+	case s.in <- data:
+	case <-s.closed:
+	default:
+		// drop datagram when queue is full
+	}
+}
+
+// Read read one datagram from client, return io.EOF when idle timeout
+func (s *Session) Read(p []byte) (int, error) {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+	for {
+		select {
+		case data := <-s.in:
+			atomic.StoreInt64(&s.active, time.Now().UnixNano())
+			return copy(p, data), nil
+		case <-s.closed:
+			return 0, io.EOF
+		case <-tk.C:
+			active := time.Unix(0, atomic.LoadInt64(&s.active))
+			if time.Since(active) > s.timeout {
+				return 0, io.EOF
+			}
+		}
+	}
+}
+
+// Write write one datagram to client
+func (s *Session) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+	return s.write(p)
+}
+
+// Close close session
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
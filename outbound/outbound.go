@@ -0,0 +1,215 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/proxyproto"
+)
+
+// Rule source address selection rule
+type Rule struct {
+	User    string       // match authenticated user, empty is any user
+	Domain  []string     // match target domain suffix
+	Network []*net.IPNet // match target ip
+	Source  []net.IP     // source addresses, selected by target family
+}
+
+// Upstream dial target through upstream proxy or tunnel, address is
+// host:port, implemented by sshtunnel.Dialer and shadowsocks.Client
+type Upstream interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// Conf outbound config
+type Conf struct {
+	Source    []net.IP      // default source addresses, selected by target family
+	Interface string        // SO_BINDTODEVICE, linux only
+	Mark      int           // SO_MARK fwmark, linux only
+	Rules     []Rule        // first matched rule selects the source addresses
+	Timeout   time.Duration // Default: no timeout
+	Resolver  *net.Resolver // Default: net.DefaultResolver
+	// ProxyProtocol send proxy protocol header of version 1 or 2 with
+	// client address on tcp connections, Default: 0 disabled
+	ProxyProtocol int
+	// Upstream dial targets by upstream instead of local network, source
+	// address and socket options are not used, Default: nil disabled
+	Upstream Upstream
+}
+
+// SetDefault check and set default value
+func (cfg *Conf) SetDefault() {
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+}
+
+// Dialer outbound dialer
+type Dialer struct {
+	cfg Conf
+}
+
+// New create dialer
+func New(cfg Conf) *Dialer {
+	cfg.SetDefault()
+	return &Dialer{cfg: cfg}
+}
+
+func (r Rule) match(user string, to addr.Addr, ip net.IP) bool {
+	if len(r.User) > 0 && r.User != user {
+		return false
+	}
+	if len(r.Domain) == 0 && len(r.Network) == 0 {
+		return true
+	}
+	if to.Type == addr.Domain {
+		domain := strings.TrimSuffix(strings.ToLower(to.Domain), ".")
+		for _, suffix := range r.Domain {
+			suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		}
+	}
+	for _, n := range r.Network {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// source select source address for target ip, nil means any address,
+// ok is false when no address has the same family with target ip
+func (d *Dialer) source(user string, to addr.Addr, ip net.IP) (net.IP, bool) {
+	list := d.cfg.Source
+	for _, r := range d.cfg.Rules {
+		if r.match(user, to, ip) {
+			list = r.Source
+			break
+		}
+	}
+	if len(list) == 0 {
+		return nil, true
+	}
+	isV4 := ip.To4() != nil
+	for _, src := range list {
+		if (src.To4() != nil) == isV4 {
+			return src, true
+		}
+	}
+	return nil, false
+}
+
+func (d *Dialer) resolve(to addr.Addr) ([]net.IP, error) {
+	switch to.Type {
+	case addr.IPV4, addr.IPV6:
+		return []net.IP{to.IP}, nil
+	case addr.Domain:
+		ctx := context.Background()
+		if d.cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.cfg.Timeout)
+			defer cancel()
+		}
+		addrs, err := d.cfg.Resolver.LookupIPAddr(ctx, to.Domain)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ret[i] = a.IP
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported address type: %d", to.Type)
+}
+
+// Dial connect target by tcp, from is the client address and user is
+// the authenticated user name, both of them may be empty
+func (d *Dialer) Dial(from, user string, to addr.Addr) (net.Conn, error) {
+	conn, err := d.dial("tcp", user, to)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg.ProxyProtocol > 0 {
+		hdr := proxyproto.Header{
+			Version:     d.cfg.ProxyProtocol,
+			Source:      parseFrom(from),
+			Destination: conn.RemoteAddr(),
+		}
+		_, err = conn.Write(hdr.Bytes())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("send proxy protocol header: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// parseFrom parse client address, return nil when it is not ip:port
+func parseFrom(from string) net.Addr {
+	host, port, err := net.SplitHostPort(from)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}
+}
+
+// DialUDP connect target by udp, the returned connection keeps message boundaries
+func (d *Dialer) DialUDP(from, user string, to addr.Addr) (net.Conn, error) {
+	return d.dial("udp", user, to)
+}
+
+func (d *Dialer) dial(network, user string, to addr.Addr) (net.Conn, error) {
+	if d.cfg.Upstream != nil {
+		host := to.Domain
+		if to.Type != addr.Domain {
+			host = to.IP.String()
+		}
+		return d.cfg.Upstream.Dial(network, net.JoinHostPort(host, strconv.Itoa(int(to.Port))))
+	}
+	ips, err := d.resolve(to)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		src, ok := d.source(user, to, ip)
+		if !ok {
+			continue
+		}
+		dialer := net.Dialer{
+			Timeout: d.cfg.Timeout,
+			Control: control(d.cfg.Interface, d.cfg.Mark),
+		}
+		if src != nil {
+			if network == "udp" {
+				dialer.LocalAddr = &net.UDPAddr{IP: src}
+			} else {
+				dialer.LocalAddr = &net.TCPAddr{IP: src}
+			}
+		}
+		conn, err := dialer.Dial(network, net.JoinHostPort(ip.String(), fmt.Sprintf("%d", to.Port)))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no source address matched target family")
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,27 @@
+package outbound
+
+import "syscall"
+
+func control(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	if len(iface) == 0 && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if len(iface) > 0 {
+				err = syscall.BindToDevice(int(fd), iface)
+				if err != nil {
+					return
+				}
+			}
+			if mark != 0 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package outbound
+
+import (
+	"errors"
+	"syscall"
+)
+
+func control(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	if len(iface) == 0 && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("interface and mark only supported on linux")
+	}
+}
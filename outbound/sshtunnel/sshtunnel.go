@@ -0,0 +1,205 @@
+// Package sshtunnel outbound dialer through ssh server by direct-tcpip
+// channels, the Dialer can be used as outbound.Conf.Upstream
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Conf ssh dialer config
+type Conf struct {
+	Addr          string // ssh server host:port
+	User          string
+	Password      string
+	KeyFile       string // private key file
+	KeyPassphrase string
+	Signers       []ssh.Signer // extra private keys
+	KnownHosts    string       // known_hosts file of server key verification
+	// HostKeyCallback verify server key, overrides KnownHosts
+	HostKeyCallback ssh.HostKeyCallback
+	Timeout         time.Duration // Default: 10s, connect and handshake timeout
+	KeepAlive       time.Duration // Default: 30s
+}
+
+// SetDefault check and set default value
+func (cfg *Conf) SetDefault() {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+}
+
+// Dialer dial targets by one reused ssh connection, reconnect when
+// keepalive failed
+type Dialer struct {
+	cfg    Conf
+	sshCfg *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// New create dialer, the ssh server is connected on first dial
+func New(cfg Conf) (*Dialer, error) {
+	cfg.SetDefault()
+	var auth []ssh.AuthMethod
+	signers := cfg.Signers
+	if len(cfg.KeyFile) > 0 {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %v", err)
+		}
+		var signer ssh.Signer
+		if len(cfg.KeyPassphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(cfg.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse key file: %v", err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(cfg.Password) > 0 {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	hostKey := cfg.HostKeyCallback
+	if hostKey == nil {
+		if len(cfg.KnownHosts) == 0 {
+			return nil, errors.New("known hosts or host key callback required")
+		}
+		var err error
+		hostKey, err = knownhosts.New(cfg.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("load known hosts: %v", err)
+		}
+	}
+	return &Dialer{
+		cfg: cfg,
+		sshCfg: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         cfg.Timeout,
+		},
+	}, nil
+}
+
+// connect get reused ssh client or connect a new one
+func (d *Dialer) connect() (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	conn, err := net.DialTimeout("tcp", d.cfg.Addr, d.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(d.cfg.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.cfg.Addr, d.sshCfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	d.client = ssh.NewClient(c, chans, reqs)
+	go d.keepAlive(d.client)
+	return d.client, nil
+}
+
+// drop close broken client
+func (d *Dialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
+
+func (d *Dialer) keepAlive(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	tk := time.NewTicker(d.cfg.KeepAlive)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			ret := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				ret <- err
+			}()
+			var err error
+			select {
+			case err = <-ret:
+			case <-time.After(d.cfg.Timeout):
+				err = errors.New("keepalive timeout")
+			}
+			if err != nil {
+				d.drop(client)
+				return
+			}
+		case <-done:
+			d.drop(client)
+			return
+		}
+	}
+}
+
+// Dial connect address through ssh server, only tcp is supported, the
+// ssh connection is reconnected once when broken
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		client, err := d.connect()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial(network, address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if _, ok := err.(*ssh.OpenChannelError); ok {
+			// rejected by server, the connection is fine
+			break
+		}
+		d.drop(client)
+	}
+	return nil, lastErr
+}
+
+// Close close ssh connection
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	client := d.client
+	d.client = nil
+	d.mu.Unlock()
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package sshtunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer in-process ssh server serving direct-tcpip channels
+type testServer struct {
+	l   net.Listener
+	cfg *ssh.ServerConfig
+	key ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	cfg.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{l: l, cfg: cfg, key: signer.PublicKey()}
+	go s.serve()
+	t.Cleanup(func() {
+		l.Close()
+		s.drop()
+	})
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			ch.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		local, creqs, err := ch.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(creqs)
+		go func() {
+			defer local.Close()
+			defer remote.Close()
+			go io.Copy(remote, local)
+			io.Copy(local, remote)
+		}()
+	}
+}
+
+// drop close all accepted connections
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// writeKnownHosts write known_hosts file of addr with key
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	err := os.WriteFile(file, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// echoServer tcp server echo received data
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func newTestDialer(t *testing.T, svr *testServer, key ssh.PublicKey) *Dialer {
+	d, err := New(Conf{
+		Addr:       svr.addr(),
+		User:       "user",
+		Password:   "pass",
+		KnownHosts: writeKnownHosts(t, svr.addr(), key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func echo(t *testing.T, d *Dialer, addr, msg string) {
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestDirectTCPIP(t *testing.T) {
+	svr := newTestServer(t)
+	d := newTestDialer(t, svr, svr.key)
+	target := echoServer(t)
+	echo(t, d, target, "hello")
+	echo(t, d, target, "world")
+	if n := svr.accepted(); n != 1 {
+		t.Fatalf("ssh connections: %d, want 1", n)
+	}
+	_, err := d.Dial("udp", target)
+	if err == nil {
+		t.Fatal("udp dialed")
+	}
+}
+
+func TestKnownHostsMismatch(t *testing.T) {
+	svr := newTestServer(t)
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDialer(t, svr, other)
+	_, err = d.Dial("tcp", echoServer(t))
+	if err == nil {
+		t.Fatal("dialed with mismatched host key")
+	}
+	if !strings.Contains(err.Error(), "key mismatch") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	svr := newTestServer(t)
+	d := newTestDialer(t, svr, svr.key)
+	target := echoServer(t)
+	echo(t, d, target, "before")
+	svr.drop()
+	echo(t, d, target, "after")
+	if n := svr.accepted(); n != 1 {
+		t.Fatalf("ssh connections after drop: %d, want 1", n)
+	}
+}
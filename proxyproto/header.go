@@ -0,0 +1,213 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// signature of version 2 header
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader no proxy protocol header
+var ErrNoHeader = errors.New("proxy protocol header not found")
+
+// Header proxy protocol header
+type Header struct {
+	Version     int  // 1 or 2
+	Local       bool // LOCAL command or UNKNOWN protocol, addresses should be ignored
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read read proxy protocol header of version 1 or 2
+func Read(r *bufio.Reader) (*Header, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch data[0] {
+	case 'P':
+		data, err = r.Peek(6)
+		if err != nil || string(data) != "PROXY " {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case sigV2[0]:
+		data, err = r.Peek(len(sigV2))
+		if err != nil || !bytes.Equal(data, sigV2) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	// max length is 107 bytes include CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	h := &Header{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		h.Local = true
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol v1 protocol: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source = src
+	h.Destination = dst
+	return h, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 address: %s", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 port: %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var hdr [16]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid proxy protocol v2 version: %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{Version: 2}
+	switch hdr[12] & 0xf {
+	case 0x0:
+		h.Local = true
+		return h, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol v2 command: %d", hdr[12]&0xf)
+	}
+	var size int
+	switch hdr[13] >> 4 {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// unspec or unix socket
+		h.Local = true
+		return h, nil
+	}
+	if len(payload) < size*2+4 {
+		return nil, errors.New("invalid proxy protocol v2 address")
+	}
+	srcIP := net.IP(payload[:size])
+	dstIP := net.IP(payload[size : size*2])
+	srcPort := int(binary.BigEndian.Uint16(payload[size*2:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[size*2+2:]))
+	if hdr[13]&0xf == 0x2 {
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return h, nil
+}
+
+func splitAddr(a net.Addr) (net.IP, int, bool) {
+	switch addr := a.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, false
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	}
+	return nil, 0, false
+}
+
+// Bytes encode header, the addresses must be *net.TCPAddr or *net.UDPAddr
+// with same family, otherwise encoded as LOCAL command
+func (h Header) Bytes() []byte {
+	srcIP, srcPort, udp := splitAddr(h.Source)
+	dstIP, dstPort, _ := splitAddr(h.Destination)
+	local := h.Local || srcIP == nil || dstIP == nil ||
+		(srcIP.To4() == nil) != (dstIP.To4() == nil)
+	if h.Version == 1 {
+		if local || udp {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if srcIP.To4() == nil {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, srcIP.String(), dstIP.String(), srcPort, dstPort))
+	}
+	var buf bytes.Buffer
+	buf.Write(sigV2)
+	if local {
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	buf.WriteByte(0x21)
+	fam := byte(0x10)
+	src, dst := []byte(srcIP.To4()), []byte(dstIP.To4())
+	if src == nil {
+		fam = 0x20
+		src, dst = srcIP.To16(), dstIP.To16()
+	}
+	if udp {
+		fam |= 0x2
+	} else {
+		fam |= 0x1
+	}
+	buf.WriteByte(fam)
+	binary.Write(&buf, binary.BigEndian, uint16(len(src)*2+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+	binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+	return buf.Bytes()
+}
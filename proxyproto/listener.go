@@ -0,0 +1,156 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("use of closed network connection")
+
+// Conf listener config
+type Conf struct {
+	Trusted  []*net.IPNet  // header is only read from these sources, Default: trust nothing
+	Required bool          // Default: false, allow trusted sources without header
+	Timeout  time.Duration // Default: 5s, read header timeout
+}
+
+// SetDefault check and set default value
+func (cfg *Conf) SetDefault() {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+}
+
+// Conn connection with addresses from proxy protocol header
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+// Read read from connection after header
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr real client address
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && !c.header.Local {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr original destination address
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && !c.header.Local {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Header proxy protocol header, nil when not received
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Listener accept connections with proxy protocol header, the header
+// is read in background so a slow client does not block Accept
+type Listener struct {
+	net.Listener
+	cfg   Conf
+	ch    chan acceptResult
+	done  chan struct{}
+	once  sync.Once
+	start sync.Once
+}
+
+// NewListener create listener
+func NewListener(l net.Listener, cfg Conf) *Listener {
+	cfg.SetDefault()
+	return &Listener{
+		Listener: l,
+		cfg:      cfg,
+		ch:       make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *Listener) trusted(a net.Addr) bool {
+	ip, _, _ := splitAddr(a)
+	for _, n := range l.cfg.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) loop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.ch <- acceptResult{err: err}:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	if l.trusted(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(l.cfg.Timeout))
+		h, err := Read(c.r)
+		conn.SetReadDeadline(time.Time{})
+		switch {
+		case err == nil:
+			c.header = h
+		case err == ErrNoHeader && !l.cfg.Required:
+		default:
+			conn.Close()
+			return
+		}
+	}
+	select {
+	case l.ch <- acceptResult{conn: c}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept accept connection, the returned connection is *Conn
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.loop()
+	})
+	select {
+	case ret := <-l.ch:
+		return ret.conn, ret.err
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+// Close close listener
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
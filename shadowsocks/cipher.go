@@ -0,0 +1,88 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// supported methods
+const (
+	MethodChacha20Poly1305 = "chacha20-ietf-poly1305"
+	MethodAES256GCM        = "aes-256-gcm"
+	MethodAES128GCM        = "aes-128-gcm"
+)
+
+// https://shadowsocks.org/doc/aead.html
+const subkeyInfo = "ss-subkey"
+
+// Cipher aead cipher with master key
+type Cipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewCipher create cipher of method, master key is derived from password
+func NewCipher(method, password string) (*Cipher, error) {
+	var c Cipher
+	var keySize int
+	switch strings.ToLower(method) {
+	case MethodChacha20Poly1305:
+		keySize = chacha20poly1305.KeySize
+		c.newAEAD = chacha20poly1305.New
+	case MethodAES256GCM:
+		keySize = 32
+		c.newAEAD = newGCM
+	case MethodAES128GCM:
+		keySize = 16
+		c.newAEAD = newGCM
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", method)
+	}
+	c.key = kdf(password, keySize)
+	return &c, nil
+}
+
+// kdf EVP_BytesToKey of openssl with md5
+func kdf(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// SaltSize salt size of cipher, same as key size
+func (c *Cipher) SaltSize() int {
+	return len(c.key)
+}
+
+// aead create aead by subkey of salt
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	_, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte(subkeyInfo)), subkey)
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
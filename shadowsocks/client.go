@@ -0,0 +1,134 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+)
+
+// ClientConf client config
+type ClientConf struct {
+	ServerAddr string        // Default: 127.0.0.1:8388
+	Method     string        // Default: chacha20-ietf-poly1305
+	Password   string        // required
+	Timeout    time.Duration // Default: 10s, connect timeout
+}
+
+// SetDefault check and set default value
+func (cfg *ClientConf) SetDefault() {
+	if len(cfg.ServerAddr) == 0 {
+		cfg.ServerAddr = "127.0.0.1:8388"
+	}
+	if len(cfg.Method) == 0 {
+		cfg.Method = MethodChacha20Poly1305
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+}
+
+// Client shadowsocks client
+type Client struct {
+	cfg    ClientConf
+	cipher *Cipher
+}
+
+// NewClient create client
+func NewClient(cfg ClientConf) (*Client, error) {
+	cfg.SetDefault()
+	cipher, err := NewCipher(cfg.Method, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cfg: cfg, cipher: cipher}, nil
+}
+
+func parseAddr(address string) (addr.Addr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return addr.Addr{Type: addr.Unknown}, fmt.Errorf("split host:port: %v", err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return addr.Addr{Type: addr.Unknown}, fmt.Errorf("parse port: %v", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr.FromIP(ip, uint16(p)), nil
+	}
+	return addr.Addr{Type: addr.Domain, Domain: host, Port: uint16(p)}, nil
+}
+
+// Dial connect address by server, network is tcp or udp, udp connection
+// keeps message boundaries
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	to, err := parseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := net.DialTimeout("tcp", c.cfg.ServerAddr, c.cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("connect: %v", err)
+		}
+		sc := newStreamConn(conn, c.cipher, nil)
+		_, err = sc.Write(to.Bytes())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("send target address: %v", err)
+		}
+		return sc, nil
+	case "udp", "udp4", "udp6":
+		conn, err := net.DialTimeout("udp", c.cfg.ServerAddr, c.cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("connect: %v", err)
+		}
+		return &udpConn{Conn: conn, cipher: c.cipher, to: to}, nil
+	}
+	return nil, fmt.Errorf("unsupported network: %s", network)
+}
+
+var errUnexpectedAddr = errors.New("unexpected source address")
+
+// udpConn packets to one target by server
+type udpConn struct {
+	net.Conn
+	cipher *Cipher
+	to     addr.Addr
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		payload, err := c.cipher.unpack(buf[:n])
+		if err != nil {
+			// drop invalid packet
+			continue
+		}
+		_, size, err := addr.Parse(payload)
+		if err != nil {
+			return 0, errUnexpectedAddr
+		}
+		return copy(p, payload[size:]), nil
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	packet, err := c.cipher.pack(append(c.to.Bytes(), p...))
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.Conn.Write(packet)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+package shadowsocks
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+var errShortPacket = errors.New("short packet")
+
+// pack seal one udp packet, salt is followed by sealed payload with zero nonce
+func (c *Cipher) pack(payload []byte) ([]byte, error) {
+	salt := make([]byte, c.SaltSize())
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), payload, nil), nil
+}
+
+// unpack open one udp packet
+func (c *Cipher) unpack(packet []byte) ([]byte, error) {
+	if len(packet) < c.SaltSize() {
+		return nil, errShortPacket
+	}
+	salt := packet[:c.SaltSize()]
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) < c.SaltSize()+aead.Overhead() {
+		return nil, errShortPacket
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), packet[c.SaltSize():], nil)
+}
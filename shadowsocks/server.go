@@ -0,0 +1,167 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/internal/aead"
+	"github.com/lwch/proxy/internal/udpsession"
+	"github.com/lwch/proxy/outbound"
+	"github.com/lwch/proxy/proxyproto"
+)
+
+// ServerHandler server handler
+type ServerHandler interface {
+	LogDebug(format string, a ...interface{})
+	LogError(format string, a ...interface{})
+	LogInfo(format string, a ...interface{})
+	Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+	Forward(local, remote io.ReadWriteCloser)
+}
+
+// UDPHandler optional interface of ServerHandler, ConnectUDP is used
+// for udp sessions and the returned connection must keep message boundaries,
+// when not implemented udp sessions are dialed by ServerConf.Outbound
+type UDPHandler interface {
+	ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
+// ServerConf server config
+type ServerConf struct {
+	Method      string        // Default: chacha20-ietf-poly1305
+	Password    string        // required
+	ReadTimeout time.Duration // Default: 10s, timeout of reading target address
+	UDPTimeout  time.Duration // Default: 60s
+	Handler     ServerHandler
+	Outbound    outbound.Conf // used by default handler and udp sessions
+	// ProxyProtocol accept proxy protocol header of tcp connections from
+	// trusted sources, Default: nil disabled
+	ProxyProtocol *proxyproto.Conf
+}
+
+// SetDefault check and set default value
+func (cfg *ServerConf) SetDefault() {
+	if len(cfg.Method) == 0 {
+		cfg.Method = MethodChacha20Poly1305
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 10 * time.Second
+	}
+	if cfg.UDPTimeout <= 0 {
+		cfg.UDPTimeout = time.Minute
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = defaultServerHandler{out: outbound.New(cfg.Outbound)}
+	}
+}
+
+// Server shadowsocks server
+type Server struct {
+	cfg      ServerConf
+	cipher   *Cipher
+	initErr  error
+	filter   *aead.SaltFilter
+	out      *outbound.Dialer
+	listener net.Listener
+	udp      net.PacketConn
+
+	// runtime
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	sessions map[string]*udpsession.Session
+}
+
+// NewServer create server, invalid method is returned by ListenAndServe
+func NewServer(cfg ServerConf) *Server {
+	cfg.SetDefault()
+	svr := &Server{
+		cfg:      cfg,
+		filter:   aead.NewSaltFilter(100000),
+		out:      outbound.New(cfg.Outbound),
+		sessions: make(map[string]*udpsession.Session),
+	}
+	svr.cipher, svr.initErr = NewCipher(cfg.Method, cfg.Password)
+	svr.ctx, svr.cancel = context.WithCancel(context.Background())
+	return svr
+}
+
+// Shutdown service shutdown
+func (s *Server) Shutdown() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// ListenAndServe listen and serve tcp connections
+func (s *Server) ListenAndServe(addr string) error {
+	if s.initErr != nil {
+		return s.initErr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serve tcp connections accepted by l
+func (s *Server) Serve(l net.Listener) error {
+	if s.initErr != nil {
+		return s.initErr
+	}
+	if s.cfg.ProxyProtocol != nil {
+		l = proxyproto.NewListener(l, *s.cfg.ProxyProtocol)
+	}
+	s.listener = l
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handleSocket(conn)
+	}
+}
+
+func (s *Server) handleSocket(c net.Conn) {
+	defer c.Close()
+	conn := newStreamConn(c, s.cipher, s.filter)
+	conn.SetReadDeadline(time.Now().Add(s.cfg.ReadTimeout))
+	to, err := addr.Read(conn)
+	if err != nil {
+		// drain to avoid probing by connection reset timing
+		s.cfg.Handler.LogError("read target address failed" + errInfo(c, err))
+		io.Copy(io.Discard, c)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	remote, _, err := s.cfg.Handler.Connect(c.RemoteAddr().String(), to)
+	if err != nil {
+		s.cfg.Handler.LogError("connect %s failed"+errInfo(c, err), to.String())
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(conn, remote)
+}
+
+func errInfo(c net.Conn, err error) string {
+	return fmt.Sprintf("; addr=%s, err=%v", c.RemoteAddr().String(), err)
+}
@@ -0,0 +1,13 @@
+package shadowsocks
+
+import (
+	"net"
+
+	"github.com/lwch/proxy/internal/aead"
+)
+
+// newStreamConn tcp stream of aead chunks, subkeys of both directions are
+// derived from master key and salt
+func newStreamConn(c net.Conn, cipher *Cipher, filter *aead.SaltFilter) *aead.Conn {
+	return aead.NewConn(c, cipher.SaltSize(), cipher.aead, cipher.aead, filter)
+}
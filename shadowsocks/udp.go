@@ -0,0 +1,96 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/internal/udpsession"
+)
+
+// ListenAndServeUDP listen and serve udp packets, each client address and
+// target is forwarded by one session until idle timeout
+func (s *Server) ListenAndServeUDP(address string) error {
+	if s.initErr != nil {
+		return s.initErr
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	s.udp = pc
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		payload, err := s.cipher.unpack(buf[:n])
+		if err != nil {
+			s.cfg.Handler.LogError("unpack udp packet failed; addr=%s, err=%v", from.String(), err)
+			continue
+		}
+		to, size, err := addr.Parse(payload)
+		if err != nil {
+			s.cfg.Handler.LogError("read udp target address failed; addr=%s, err=%v", from.String(), err)
+			continue
+		}
+		key := from.String() + "-" + to.String()
+		s.mu.Lock()
+		sess, ok := s.sessions[key]
+		if !ok {
+			sess = s.newUDPSession(pc, from, to)
+			s.sessions[key] = sess
+			go s.handleSession(key, from, to, sess)
+		}
+		s.mu.Unlock()
+		sess.Push(payload[size:])
+	}
+}
+
+// newUDPSession create session of one client address to one target, replies
+// are sent with target address
+func (s *Server) newUDPSession(pc net.PacketConn, from net.Addr, to addr.Addr) *udpsession.Session {
+	return udpsession.New(s.cfg.UDPTimeout, func(p []byte) (int, error) {
+		packet, err := s.cipher.pack(append(to.Bytes(), p...))
+		if err != nil {
+			return 0, err
+		}
+		_, err = pc.WriteTo(packet, from)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+func (s *Server) handleSession(key string, from net.Addr, to addr.Addr, sess *udpsession.Session) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}()
+	defer sess.Close()
+	var remote io.ReadWriteCloser
+	var err error
+	if h, ok := s.cfg.Handler.(UDPHandler); ok {
+		remote, _, err = h.ConnectUDP(from.String(), to)
+	} else {
+		remote, err = s.out.DialUDP(from.String(), "", to)
+	}
+	if err != nil {
+		s.cfg.Handler.LogError("connect udp %s failed; addr=%s, err=%v",
+			to.String(), from.String(), err)
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(sess, remote)
+}
@@ -0,0 +1,225 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// max bytes to peek, large enough for tls ClientHello and http request header
+const maxPeek = 16 * 1024
+
+// Conn connection replaying the peeked data
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read read peeked data first and then from connection
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Sniff peek the first bytes of c and extract host name from tls ClientHello
+// SNI or http Host header, the returned connection must be used for later read
+func Sniff(c net.Conn, timeout time.Duration) (string, net.Conn) {
+	conn := &Conn{Conn: c, r: bufio.NewReaderSize(c, maxPeek)}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	hdr, err := conn.r.Peek(1)
+	if err != nil {
+		return "", conn
+	}
+	if hdr[0] == 0x16 {
+		return peekTLS(conn.r), conn
+	}
+	return peekHTTP(conn.r), conn
+}
+
+func peekTLS(r *bufio.Reader) string {
+	hdr, err := r.Peek(5)
+	if err != nil {
+		return ""
+	}
+	size := 5 + int(binary.BigEndian.Uint16(hdr[3:]))
+	if size > maxPeek {
+		size = maxPeek
+	}
+	data, err := r.Peek(size)
+	if err != nil {
+		return ""
+	}
+	name, _ := ServerName(data)
+	return name
+}
+
+func peekHTTP(r *bufio.Reader) string {
+	for {
+		data, err := r.Peek(r.Buffered())
+		if err != nil {
+			return ""
+		}
+		if !maybeHTTP(data) {
+			return ""
+		}
+		if host, ok := HTTPHost(data); ok {
+			return host
+		}
+		if bytes.Contains(data, []byte("\r\n\r\n")) || len(data) >= maxPeek {
+			return ""
+		}
+		// wait for more data
+		_, err = r.Peek(len(data) + 1)
+		if err != nil {
+			return ""
+		}
+	}
+}
+
+// ServerName parse SNI from tls ClientHello record
+func ServerName(data []byte) (string, bool) {
+	// record header
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", false
+	}
+	data = data[5:]
+	// handshake header
+	if len(data) < 4 || data[0] != 0x01 {
+		return "", false
+	}
+	data = data[4:]
+	// version(2) + random(32)
+	if len(data) < 34 {
+		return "", false
+	}
+	data = data[34:]
+	// session id
+	data, ok := skip8(data)
+	if !ok {
+		return "", false
+	}
+	// cipher suites
+	data, ok = skip16(data)
+	if !ok {
+		return "", false
+	}
+	// compression methods
+	data, ok = skip8(data)
+	if !ok {
+		return "", false
+	}
+	if len(data) < 2 {
+		return "", false
+	}
+	exts := data[2:]
+	if n := int(binary.BigEndian.Uint16(data)); n < len(exts) {
+		exts = exts[:n]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		size := int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if len(exts) < size {
+			return "", false
+		}
+		ext := exts[:size]
+		exts = exts[size:]
+		if typ != 0x00 {
+			continue
+		}
+		// server_name_list
+		if len(ext) < 2 {
+			return "", false
+		}
+		list := ext[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			l := int(binary.BigEndian.Uint16(list[1:]))
+			list = list[3:]
+			if len(list) < l {
+				return "", false
+			}
+			if nameType == 0x00 {
+				return string(list[:l]), true
+			}
+			list = list[l:]
+		}
+		return "", false
+	}
+	return "", false
+}
+
+func skip8(data []byte) ([]byte, bool) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, false
+	}
+	return data[1+int(data[0]):], true
+}
+
+func skip16(data []byte) ([]byte, bool) {
+	if len(data) < 2 {
+		return nil, false
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	if len(data) < n {
+		return nil, false
+	}
+	return data[n:], true
+}
+
+var methods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// maybeHTTP check data starts with a method or is a prefix of a method
+func maybeHTTP(data []byte) bool {
+	for _, m := range methods {
+		n := len(data)
+		if n > len(m) {
+			n = len(m)
+		}
+		if string(data[:n]) == m[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPHost parse host name without port from http request Host header
+func HTTPHost(data []byte) (string, bool) {
+	ok := false
+	for _, m := range methods {
+		if bytes.HasPrefix(data, []byte(m)) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return "", false
+	}
+	lines := strings.Split(string(data), "\r\n")
+	if len(lines) < 2 {
+		return "", false
+	}
+	// the last line may be incomplete
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) == 0 {
+			break
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 || !strings.EqualFold(strings.TrimSpace(line[:idx]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(line[idx+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if len(host) == 0 {
+			return "", false
+		}
+		return host, true
+	}
+	return "", false
+}
@@ -0,0 +1,43 @@
+package sniff
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHTTPHost(t *testing.T) {
+	cases := []struct {
+		data string
+		host string
+		ok   bool
+	}{
+		{"GET / HTTP/1.1", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: example.com:8080\r\n", "example.com", true},
+		{"GET / HTTP/1.1\r\nhost: [::1]:80\r\n\r\n", "::1", true},
+		{"GET / HTTP/1.1\r\nUser-Agent: x\r\n\r\nHost: example.com\r\n", "", false},
+		{"SSH-2.0-OpenSSH\r\nHost: example.com\r\n", "", false},
+	}
+	for _, c := range cases {
+		host, ok := HTTPHost([]byte(c.data))
+		if host != c.host || ok != c.ok {
+			t.Errorf("HTTPHost(%q) = %q, %v, want %q, %v", c.data, host, ok, c.host, c.ok)
+		}
+	}
+}
+
+func TestSniffNotHTTP(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	begin := time.Now()
+	host, _ := Sniff(local, time.Second)
+	if len(host) > 0 {
+		t.Fatalf("unexpected host: %s", host)
+	}
+	if time.Since(begin) > 500*time.Millisecond {
+		t.Fatalf("sniff waited for timeout")
+	}
+}
@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Authenticator server side sub-negotiation of one auth method, the
+// connection deadline is set by server before Authenticate
+type Authenticator interface {
+	Method() Method
+	// Authenticate negotiate with client after the method selected, return
+	// authenticated user and connection of following requests, which may
+	// wrap c for encapsulation
+	Authenticate(c net.Conn) (string, net.Conn, error)
+}
+
+// ClientAuthenticator client side sub-negotiation of one auth method
+type ClientAuthenticator interface {
+	Method() Method
+	// Authenticate negotiate with server after the method selected, return
+	// connection of following requests, which may wrap c for encapsulation
+	Authenticate(c net.Conn) (net.Conn, error)
+}
+
+// NoAuth no authentication required
+type NoAuth struct{}
+
+// Method get method
+func (NoAuth) Method() Method { return MethodNoAuth }
+
+// Authenticate always success
+func (NoAuth) Authenticate(c net.Conn) (string, net.Conn, error) {
+	return "", c, nil
+}
+
+// UserPass user/pass authentication, https://www.rfc-editor.org/rfc/rfc1929
+type UserPass struct {
+	Check func(user, pass string) bool
+	// CheckFrom used instead of Check when set, from is client address
+	CheckFrom func(from, user, pass string) bool
+}
+
+// Method get method
+func (UserPass) Method() Method { return MethodUserPass }
+
+// Authenticate read user/pass and reply status of Check
+func (a UserPass) Authenticate(c net.Conn) (string, net.Conn, error) {
+	user, pass, err := waitUserPass(c)
+	if err != nil {
+		return "", nil, err
+	}
+	var ok bool
+	if a.CheckFrom != nil {
+		ok = a.CheckFrom(c.RemoteAddr().String(), user, pass)
+	} else {
+		ok = a.Check(user, pass)
+	}
+	if !ok {
+		c.Write([]byte{0x01, 0x01})
+		return user, nil, fmt.Errorf("invalid user/pass, user=%s", user)
+	}
+	_, err = c.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return user, nil, err
+	}
+	return user, c, nil
+}
+
+// ClientNoAuth no authentication required
+type ClientNoAuth struct{}
+
+// Method get method
+func (ClientNoAuth) Method() Method { return MethodNoAuth }
+
+// Authenticate nothing to negotiate
+func (ClientNoAuth) Authenticate(c net.Conn) (net.Conn, error) {
+	return c, nil
+}
+
+// ClientUserPass user/pass authentication, https://www.rfc-editor.org/rfc/rfc1929
+type ClientUserPass struct {
+	User string
+	Pass string
+}
+
+// Method get method
+func (ClientUserPass) Method() Method { return MethodUserPass }
+
+// Authenticate send user/pass and check status
+func (a ClientUserPass) Authenticate(c net.Conn) (net.Conn, error) {
+	user, pass := a.User, a.Pass
+	if len(user) > 255 {
+		user = user[:255]
+	}
+	if len(pass) > 255 {
+		pass = pass[:255]
+	}
+	buf := []byte{0x01, byte(len(user))}
+	buf = append(buf, user...)
+	buf = append(buf, byte(len(pass)))
+	buf = append(buf, pass...)
+	_, err := c.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	var rep [2]byte
+	_, err = io.ReadFull(c, rep[:])
+	if err != nil {
+		return nil, err
+	}
+	if rep[0] != 0x01 {
+		return nil, fmt.Errorf("invalid auth version: %d", rep[0])
+	}
+	if rep[1] != 0 {
+		return nil, ErrAuth
+	}
+	return c, nil
+}
@@ -1,11 +1,15 @@
 package socks5
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/lwch/proxy/addr"
@@ -16,6 +20,25 @@ type ClientConf struct {
 	ServerAddr   string        // Default: 127.0.0.1:1080
 	ReadTimeout  time.Duration // Default: 1s
 	WriteTimeout time.Duration // Default: 1s
+	// TLS connect server over tls, Default: nil disabled
+	TLS *tls.Config
+	// PinSHA256 base64 sha256 of server public key, connect over tls and
+	// verify by pinning instead of certificate chain when set
+	PinSHA256 []string
+	// PSK encrypt connections by pre-shared key, must be same as server and
+	// be at least 32 random bytes since it is not stretched
+	PSK []byte
+	// WebSocket connect server by ws:// or wss:// url instead of ServerAddr,
+	// tls config and pins are used by wss
+	WebSocket       string
+	WebSocketHeader http.Header // extra headers of websocket handshake
+	// Authenticators auth methods offered in order, Default: ClientUserPass
+	// with user/pass of dial, or ClientNoAuth when user/pass is empty
+	Authenticators []ClientAuthenticator
+	// Mux count of long-lived connections to open streams for each dial,
+	// falls back to plain socks5 when not supported by server, Default: 0 disabled
+	Mux       int
+	KeepAlive time.Duration // Default: 30s, keepalive interval of mux sessions
 }
 
 // SetDefault check and set default value
@@ -29,12 +52,20 @@ func (cfg *ClientConf) SetDefault() {
 	if cfg.WriteTimeout <= 0 {
 		cfg.WriteTimeout = time.Second
 	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
 }
 
 // Client socks5 client
 type Client struct {
 	cfg    ClientConf
 	server *net.TCPAddr
+	tls    *tls.Config
+
+	// mux sessions by user/pass
+	mu       sync.Mutex
+	sessions map[string][]*muxSession
 }
 
 // NewClient create client
@@ -44,9 +75,16 @@ func NewClient(cfg ClientConf) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	tlsCfg, err := clientTLS(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %v", err)
+	}
 	return &Client{
 		cfg:    cfg,
 		server: addr,
+		tls:    tlsCfg,
+
+		sessions: make(map[string][]*muxSession),
 	}, nil
 }
 
@@ -68,36 +106,6 @@ func waitHandshakeResponse(conn net.Conn, timeout time.Duration) (Method, error)
 	return Method(buf[1]), nil
 }
 
-func (c *Client) handshakeUserPass(conn net.Conn, user, pass string) error {
-	if len(user) >= 255 {
-		user = user[:255]
-	}
-	if len(pass) >= 255 {
-		pass = pass[:255]
-	}
-	buf := []byte{0x01, byte(len(user))}
-	buf = append(buf, user...)
-	buf = append(buf, byte(len(pass)))
-	buf = append(buf, pass...)
-	err := writeTimeout(conn, buf, c.cfg.WriteTimeout)
-	if err != nil {
-		return err
-	}
-	conn.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
-	var rep [2]byte
-	_, err = io.ReadFull(conn, rep[:])
-	if err != nil {
-		return err
-	}
-	if rep[0] != 0x01 {
-		return fmt.Errorf("invalid auth version: %d", rep[0])
-	}
-	if rep[1] != 0 {
-		return fmt.Errorf("invalid auth")
-	}
-	return nil
-}
-
 func (c *Client) request(conn net.Conn, a string) error {
 	host, port, err := net.SplitHostPort(a)
 	if err != nil {
@@ -119,80 +127,170 @@ func (c *Client) request(conn net.Conn, a string) error {
 		reqAddr.Type = addr.IPV6
 		reqAddr.IP = ip
 	}
-	err = writeTimeout(conn, append([]byte{VERSION, byte(CmdConnect), 0x00},
+	_, err = c.command(conn, CmdConnect, reqAddr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// command send cmd request and return the address in reply
+func (c *Client) command(conn net.Conn, cmd Cmd, reqAddr addr.Addr) (addr.Addr, error) {
+	err := writeTimeout(conn, append([]byte{VERSION, byte(cmd), 0x00},
 		reqAddr.Bytes()...), c.cfg.WriteTimeout)
 	if err != nil {
-		return fmt.Errorf("send connect: %v", err)
+		return errAddr, fmt.Errorf("send request: %v", err)
 	}
 	var hdr [4]byte
 	conn.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
 	_, err = io.ReadFull(conn, hdr[:])
 	if err != nil {
-		return fmt.Errorf("read response header: %v", err)
+		return errAddr, fmt.Errorf("read response header: %v", err)
 	}
 	if hdr[0] != VERSION {
-		return fmt.Errorf("invalid version: %d", hdr[0])
+		return errAddr, fmt.Errorf("invalid version: %d", hdr[0])
 	}
 	if hdr[1] != byte(ReplyOK) {
-		return fmt.Errorf("connect: %s", Reply(hdr[1]).String())
+		return errAddr, fmt.Errorf("connect: %s", Reply(hdr[1]).String())
 	}
-	switch addr.Type(hdr[3]) {
+	bind := addr.Addr{Type: addr.Type(hdr[3])}
+	switch bind.Type {
 	case addr.IPV4:
-		var addrPort [net.IPv4len + 2]byte
-		_, err = io.ReadFull(conn, addrPort[:])
+		bind.IP, bind.Port, err = readIPAddr(conn, net.IPv4len)
 	case addr.IPV6:
-		var addrPort [net.IPv6len + 2]byte
-		_, err = io.ReadFull(conn, addrPort[:])
+		bind.IP, bind.Port, err = readIPAddr(conn, net.IPv6len)
 	case addr.Domain:
 		var l [1]byte
 		_, err = conn.Read(l[:])
 		if err != nil {
-			return errors.New("read domain length")
+			return errAddr, errors.New("read domain length")
 		}
 		domain := make([]byte, l[0]+2)
 		_, err = io.ReadFull(conn, domain[:])
+		if err == nil {
+			bind.Domain = string(domain[:l[0]])
+			bind.Port = binary.BigEndian.Uint16(domain[l[0]:])
+		}
 	default:
-		return errors.New("response unknown address")
+		return errAddr, errors.New("response unknown address")
 	}
 	if err != nil {
-		return fmt.Errorf("read addr: %v", err)
+		return errAddr, fmt.Errorf("read addr: %v", err)
 	}
-	return nil
+	return bind, nil
 }
 
-// DialUserPass connect address with user/pass and reply connection
-func (c *Client) DialUserPass(addr, user, pass string) (net.Conn, error) {
-	conn, err := net.DialTCP("tcp", nil, c.server)
+// dial connect server by tcp, tls or websocket transport and wrap by
+// psk layer
+func (c *Client) dial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if len(c.cfg.WebSocket) > 0 {
+		conn, err = c.dialWebSocket()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		conn, err = net.DialTCP("tcp", nil, c.server)
+		if err != nil {
+			return nil, fmt.Errorf("connect: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(c.cfg.ReadTimeout + c.cfg.WriteTimeout))
+		if c.tls != nil {
+			tc := tls.Client(conn, c.tls)
+			err = tc.Handshake()
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("tls handshake: %v", err)
+			}
+			conn = tc
+		}
+	}
+	if len(c.cfg.PSK) > 0 {
+		conn = newPSKConn(conn, c.cfg.PSK, false, nil)
+	}
+	return conn, nil
+}
+
+// handshake connect server and authenticate with user/pass, return
+// stream of mux session when ClientConf.Mux enabled
+func (c *Client) handshake(user, pass string) (net.Conn, error) {
+	if c.cfg.Mux > 0 {
+		return c.muxHandshake(user, pass)
+	}
+	conn, err := c.dial()
 	if err != nil {
-		return nil, fmt.Errorf("connect: %v", err)
+		return nil, err
+	}
+	ret, _, err := c.negotiate(conn, user, pass, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// authenticators get offered authenticators, built by user/pass when
+// ClientConf.Authenticators not set
+func (c *Client) authenticators(user, pass string) []ClientAuthenticator {
+	if len(c.cfg.Authenticators) > 0 {
+		return c.cfg.Authenticators
 	}
-	var wantMethod Method
 	if len(user) != 0 || len(pass) != 0 {
-		err = writeTimeout(conn, []byte{VERSION, 1, byte(MethodUserPass)}, c.cfg.WriteTimeout)
-		wantMethod = MethodUserPass
-	} else {
-		err = writeTimeout(conn, []byte{VERSION, 1, byte(MethodNoAuth)}, c.cfg.WriteTimeout)
-		wantMethod = MethodNoAuth
+		return []ClientAuthenticator{ClientUserPass{User: user, Pass: pass}}
+	}
+	return []ClientAuthenticator{ClientNoAuth{}}
+}
+
+// negotiate send methods and authenticate, MethodMux is offered first when
+// mux is true, return connection after authentication and whether the
+// server accepted mux
+func (c *Client) negotiate(conn net.Conn, user, pass string, mux bool) (net.Conn, bool, error) {
+	auths := c.authenticators(user, pass)
+	req := []byte{VERSION, 0}
+	if mux {
+		req = append(req, byte(MethodMux))
+	}
+	for _, a := range auths {
+		req = append(req, byte(a.Method()))
 	}
+	req[1] = byte(len(req) - 2)
+	err := writeTimeout(conn, req, c.cfg.WriteTimeout)
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("handshake: %v", err)
+		return nil, false, fmt.Errorf("handshake: %v", err)
 	}
 	method, err := waitHandshakeResponse(conn, c.cfg.ReadTimeout)
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("wait handshake: %v", err)
+		return nil, false, fmt.Errorf("wait handshake: %v", err)
 	}
-	if method != wantMethod {
-		conn.Close()
-		return nil, ErrMethod
+	muxed := mux && method == MethodMux
+	if muxed {
+		var m [1]byte
+		_, err = io.ReadFull(conn, m[:])
+		if err != nil {
+			return nil, false, fmt.Errorf("wait mux method: %v", err)
+		}
+		method = Method(m[0])
 	}
-	if method == MethodUserPass {
-		err = c.handshakeUserPass(conn, user, pass)
+	for _, a := range auths {
+		if a.Method() != method {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(c.cfg.ReadTimeout + c.cfg.WriteTimeout))
+		ret, err := a.Authenticate(conn)
 		if err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("handshake user/pass: %v", err)
+			return nil, false, fmt.Errorf("authenticate %s: %v", method, err)
 		}
+		return ret, muxed, nil
+	}
+	return nil, false, ErrMethod
+}
+
+// DialUserPass connect address with user/pass and reply connection
+func (c *Client) DialUserPass(addr, user, pass string) (net.Conn, error) {
+	conn, err := c.handshake(user, pass)
+	if err != nil {
+		return nil, err
 	}
 	err = c.request(conn, addr)
 	if err != nil {
@@ -202,3 +300,110 @@ func (c *Client) DialUserPass(addr, user, pass string) (net.Conn, error) {
 	conn.SetDeadline(time.Time{})
 	return conn, nil
 }
+
+// Resolve resolve domain by server, tor extension
+func (c *Client) Resolve(domain string) (net.IP, error) {
+	return c.ResolveUserPass(domain, "", "")
+}
+
+// ResolveUserPass resolve domain by server with user/pass, tor extension
+func (c *Client) ResolveUserPass(domain, user, pass string) (net.IP, error) {
+	conn, err := c.handshake(user, pass)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ret, err := c.command(conn, CmdResolve, addr.Addr{Type: addr.Domain, Domain: domain})
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %v", err)
+	}
+	if ret.Type != addr.IPV4 && ret.Type != addr.IPV6 {
+		return nil, errors.New("resolve: response unknown address")
+	}
+	return ret.IP, nil
+}
+
+// ResolvePTR resolve ip to domain by server, tor extension
+func (c *Client) ResolvePTR(ip net.IP) (string, error) {
+	return c.ResolvePTRUserPass(ip, "", "")
+}
+
+// ResolvePTRUserPass resolve ip to domain by server with user/pass, tor extension
+func (c *Client) ResolvePTRUserPass(ip net.IP, user, pass string) (string, error) {
+	conn, err := c.handshake(user, pass)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reqAddr := addr.Addr{Type: addr.IPV4, IP: ip.To4()}
+	if reqAddr.IP == nil {
+		reqAddr.Type = addr.IPV6
+		reqAddr.IP = ip.To16()
+	}
+	ret, err := c.command(conn, CmdResolvePTR, reqAddr)
+	if err != nil {
+		return "", fmt.Errorf("resolve ptr: %v", err)
+	}
+	if ret.Type != addr.Domain {
+		return "", errors.New("resolve ptr: response unknown address")
+	}
+	return ret.Domain, nil
+}
+
+// muxHandshake open stream on the least loaded mux session of user/pass,
+// new session is connected until ClientConf.Mux sessions
+func (c *Client) muxHandshake(user, pass string) (net.Conn, error) {
+	key := user + "\x00" + pass
+	c.mu.Lock()
+	var alive []*muxSession
+	var best *muxSession
+	bestStreams := 0
+	for _, sess := range c.sessions[key] {
+		n := sess.numStreams()
+		if n < 0 {
+			continue
+		}
+		alive = append(alive, sess)
+		if best == nil || n < bestStreams {
+			best, bestStreams = sess, n
+		}
+	}
+	c.sessions[key] = alive
+	c.mu.Unlock()
+	if best != nil && (len(alive) >= c.cfg.Mux || bestStreams == 0) {
+		st, err := best.open()
+		if err == nil {
+			return st, nil
+		}
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	ret, muxed, err := c.negotiate(conn, user, pass, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !muxed {
+		return ret, nil
+	}
+	sess := newMuxSession(ret, c.cfg.KeepAlive, false)
+	c.mu.Lock()
+	c.sessions[key] = append(c.sessions[key], sess)
+	c.mu.Unlock()
+	return sess.open()
+}
+
+// Close close mux sessions
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, list := range c.sessions {
+		for _, sess := range list {
+			sess.Close()
+		}
+	}
+	c.sessions = make(map[string][]*muxSession)
+	return nil
+}
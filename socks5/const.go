@@ -13,6 +13,9 @@ const (
 	MethodGSSAPI = Method(0x01)
 	// MethodUserPass user pass method
 	MethodUserPass = Method(0x02)
+	// MethodMux multiplexed streams, private method, the server replies
+	// the real auth method in one more byte
+	MethodMux = Method(0x88)
 	// MethodNotSupport not support method
 	MethodNotSupport = Method(0xff)
 )
@@ -27,6 +30,10 @@ const (
 	CmdBind = Cmd(0x02)
 	// CmdUDPForward forward udp data
 	CmdUDPForward = Cmd(0x03)
+	// CmdResolve resolve domain, tor extension
+	CmdResolve = Cmd(0xf0)
+	// CmdResolvePTR resolve ip to domain, tor extension
+	CmdResolvePTR = Cmd(0xf1)
 	// CmdUnknown unknown command
 	CmdUnknown = Cmd(0xff)
 )
@@ -39,6 +46,8 @@ func (m Method) String() string {
 		return "gssapi"
 	case MethodUserPass:
 		return "user/pass"
+	case MethodMux:
+		return "mux"
 	case MethodNotSupport:
 		return "not support"
 	}
@@ -4,3 +4,6 @@ import "errors"
 
 // ErrMethod error method
 var ErrMethod = errors.New("invalid method")
+
+// ErrAuth error authentication rejected by server
+var ErrAuth = errors.New("authentication failed")
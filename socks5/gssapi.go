@@ -0,0 +1,305 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// https://www.rfc-editor.org/rfc/rfc1961
+const (
+	gssVersion      = 0x01
+	gssMsgAuth      = 0x01
+	gssMsgProtect   = 0x02
+	gssMsgEncapsule = 0x03
+	gssMsgAbort     = 0xff
+
+	gssMaxChunk = 32 * 1024
+)
+
+// ProtectionLevel per-message protection of GSSAPI encapsulation
+type ProtectionLevel byte
+
+const (
+	// ProtectionIntegrity required per-message integrity
+	ProtectionIntegrity = ProtectionLevel(0x01)
+	// ProtectionConfidentiality required per-message integrity and confidentiality
+	ProtectionConfidentiality = ProtectionLevel(0x02)
+	// ProtectionSelective selective per-message integrity or confidentiality,
+	// treated as confidentiality
+	ProtectionSelective = ProtectionLevel(0x03)
+)
+
+var (
+	errGSSAbort   = errors.New("gssapi aborted by peer")
+	errGSSNoToken = errors.New("gssapi context not established without token")
+)
+
+// GSSContext security context of one connection, created by GSSMechanism
+type GSSContext interface {
+	// Step process token from peer, input is nil on the first step of
+	// initiator, return token sent to peer and whether the context is
+	// established
+	Step(input []byte) ([]byte, bool, error)
+	// Wrap protect message, conf requests confidentiality
+	Wrap(data []byte, conf bool) ([]byte, error)
+	// Unwrap verify and decrypt message
+	Unwrap(token []byte) ([]byte, error)
+	// Peer authenticated name of peer, used as user on server
+	Peer() string
+}
+
+// GSSMechanism create security context, acceptor for server and initiator
+// for client, e.g. kerberos
+type GSSMechanism interface {
+	NewContext() (GSSContext, error)
+}
+
+func writeGSS(c net.Conn, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("gssapi token too large: %d", len(token))
+	}
+	buf := make([]byte, 4, 4+len(token))
+	buf[0] = gssVersion
+	buf[1] = mtyp
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(token)))
+	buf = append(buf, token...)
+	_, err := c.Write(buf)
+	return err
+}
+
+func abortGSS(c net.Conn) {
+	c.Write([]byte{gssVersion, gssMsgAbort})
+}
+
+func readGSS(r io.Reader, want byte) ([]byte, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != gssVersion {
+		return nil, fmt.Errorf("invalid gssapi version: %d", hdr[0])
+	}
+	if hdr[1] == gssMsgAbort {
+		return nil, errGSSAbort
+	}
+	if hdr[1] != want {
+		return nil, fmt.Errorf("unexpected gssapi message type: %d", hdr[1])
+	}
+	var l [2]byte
+	_, err = io.ReadFull(r, l[:])
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// readLevel read protection level message
+func readLevel(c net.Conn, ctx GSSContext) (ProtectionLevel, error) {
+	token, err := readGSS(c, gssMsgProtect)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ctx.Unwrap(token)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 1 || data[0] < byte(ProtectionIntegrity) || data[0] > byte(ProtectionSelective) {
+		return 0, fmt.Errorf("invalid protection level: %v", data)
+	}
+	return ProtectionLevel(data[0]), nil
+}
+
+func writeLevel(c net.Conn, ctx GSSContext, level ProtectionLevel) error {
+	token, err := ctx.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		return err
+	}
+	return writeGSS(c, gssMsgProtect, token)
+}
+
+// GSSAPI server side GSSAPI authentication
+type GSSAPI struct {
+	Mechanism GSSMechanism
+	// Level minimum protection level, client proposal below it is answered
+	// by this level, Default: ProtectionIntegrity
+	Level ProtectionLevel
+}
+
+// Method get method
+func (GSSAPI) Method() Method { return MethodGSSAPI }
+
+// Authenticate exchange tokens until context established, negotiate
+// protection level and encapsulate following messages
+func (a GSSAPI) Authenticate(c net.Conn) (string, net.Conn, error) {
+	ctx, err := a.Mechanism.NewContext()
+	if err != nil {
+		abortGSS(c)
+		return "", nil, err
+	}
+	for done := false; !done; {
+		token, err := readGSS(c, gssMsgAuth)
+		if err != nil {
+			return "", nil, err
+		}
+		var output []byte
+		output, done, err = ctx.Step(token)
+		if err != nil {
+			abortGSS(c)
+			return "", nil, err
+		}
+		if len(output) > 0 || !done {
+			err = writeGSS(c, gssMsgAuth, output)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	level, err := readLevel(c, ctx)
+	if err != nil {
+		abortGSS(c)
+		return ctx.Peer(), nil, err
+	}
+	min := a.Level
+	if min == 0 {
+		min = ProtectionIntegrity
+	}
+	if level < min {
+		level = min
+	}
+	err = writeLevel(c, ctx, level)
+	if err != nil {
+		return ctx.Peer(), nil, err
+	}
+	return ctx.Peer(), newGSSConn(c, ctx, level), nil
+}
+
+// ClientGSSAPI client side GSSAPI authentication
+type ClientGSSAPI struct {
+	Mechanism GSSMechanism
+	// Level proposed protection level, server reply below it is rejected,
+	// Default: ProtectionConfidentiality
+	Level ProtectionLevel
+}
+
+// Method get method
+func (ClientGSSAPI) Method() Method { return MethodGSSAPI }
+
+// Authenticate exchange tokens until context established, negotiate
+// protection level and encapsulate following messages
+func (a ClientGSSAPI) Authenticate(c net.Conn) (net.Conn, error) {
+	ctx, err := a.Mechanism.NewContext()
+	if err != nil {
+		abortGSS(c)
+		return nil, err
+	}
+	var input []byte
+	for {
+		output, done, err := ctx.Step(input)
+		if err != nil {
+			abortGSS(c)
+			return nil, err
+		}
+		if len(output) == 0 && !done {
+			// server waits for token, the exchange would deadlock
+			abortGSS(c)
+			return nil, errGSSNoToken
+		}
+		if len(output) > 0 {
+			err = writeGSS(c, gssMsgAuth, output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if done {
+			break
+		}
+		input, err = readGSS(c, gssMsgAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	want := a.Level
+	if want == 0 {
+		want = ProtectionConfidentiality
+	}
+	err = writeLevel(c, ctx, want)
+	if err != nil {
+		return nil, err
+	}
+	level, err := readLevel(c, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if level < want {
+		abortGSS(c)
+		return nil, fmt.Errorf("protection level %d below %d", level, want)
+	}
+	return newGSSConn(c, ctx, level), nil
+}
+
+// gssConn encapsulate data by GSSAPI per-message protection
+type gssConn struct {
+	net.Conn
+	ctx  GSSContext
+	conf bool
+
+	rmu  sync.Mutex
+	rbuf []byte
+
+	wmu sync.Mutex
+}
+
+func newGSSConn(c net.Conn, ctx GSSContext, level ProtectionLevel) *gssConn {
+	return &gssConn{Conn: c, ctx: ctx, conf: level != ProtectionIntegrity}
+}
+
+func (c *gssConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		token, err := readGSS(c.Conn, gssMsgEncapsule)
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf, err = c.ctx.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *gssConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > gssMaxChunk {
+			n = gssMaxChunk
+		}
+		token, err := c.ctx.Wrap(p[:n], c.conf)
+		if err != nil {
+			return written, err
+		}
+		err = writeGSS(c.Conn, gssMsgEncapsule, token)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
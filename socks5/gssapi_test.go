@@ -0,0 +1,206 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeMechanism GSSMechanism exchange rounds tokens before established,
+// messages are wrapped by xor with marker of protection
+type fakeMechanism struct {
+	initiator bool
+	rounds    int
+	// noToken initiator returns empty token without established
+	noToken bool
+}
+
+func (m fakeMechanism) NewContext() (GSSContext, error) {
+	return &fakeContext{mech: m}, nil
+}
+
+type fakeContext struct {
+	mech  fakeMechanism
+	step  int
+	wraps map[bool]int // wrapped messages by conf
+}
+
+func (c *fakeContext) Step(input []byte) ([]byte, bool, error) {
+	if c.mech.initiator {
+		if c.mech.noToken {
+			return nil, false, nil
+		}
+		if c.step > 0 && string(input) != fmt.Sprintf("acc-%d", c.step-1) {
+			return nil, false, fmt.Errorf("unexpected token: %q", input)
+		}
+		if c.step == c.mech.rounds {
+			return nil, true, nil
+		}
+		c.step++
+		return []byte(fmt.Sprintf("init-%d", c.step-1)), false, nil
+	}
+	if string(input) != fmt.Sprintf("init-%d", c.step) {
+		return nil, false, fmt.Errorf("unexpected token: %q", input)
+	}
+	c.step++
+	return []byte(fmt.Sprintf("acc-%d", c.step-1)), c.step == c.mech.rounds, nil
+}
+
+func (c *fakeContext) Wrap(data []byte, conf bool) ([]byte, error) {
+	if c.wraps == nil {
+		c.wraps = make(map[bool]int)
+	}
+	c.wraps[conf]++
+	ret := []byte{'I'}
+	if conf {
+		ret[0] = 'C'
+	}
+	for _, b := range data {
+		if conf {
+			b ^= 0x5a
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+func (c *fakeContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 || (token[0] != 'I' && token[0] != 'C') {
+		return nil, errors.New("invalid token")
+	}
+	ret := make([]byte, 0, len(token)-1)
+	for _, b := range token[1:] {
+		if token[0] == 'C' {
+			b ^= 0x5a
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+func (c *fakeContext) Peer() string { return "alice" }
+
+type gssResult struct {
+	user string
+	conn net.Conn
+	err  error
+}
+
+// gssPair authenticate both sides over pipe
+func gssPair(svr GSSAPI, cli ClientGSSAPI) (gssResult, gssResult) {
+	a, b := net.Pipe()
+	ch := make(chan gssResult, 1)
+	go func() {
+		user, conn, err := svr.Authenticate(a)
+		if err != nil {
+			a.Close()
+		}
+		ch <- gssResult{user: user, conn: conn, err: err}
+	}()
+	conn, err := cli.Authenticate(b)
+	if err != nil {
+		b.Close()
+	}
+	return <-ch, gssResult{conn: conn, err: err}
+}
+
+func TestGSSAPIExchange(t *testing.T) {
+	svr, cli := gssPair(
+		GSSAPI{Mechanism: fakeMechanism{rounds: 3}},
+		ClientGSSAPI{Mechanism: fakeMechanism{initiator: true, rounds: 3}})
+	if svr.err != nil || cli.err != nil {
+		t.Fatalf("server: %v, client: %v", svr.err, cli.err)
+	}
+	if svr.user != "alice" {
+		t.Fatalf("user: %s", svr.user)
+	}
+	if !svr.conn.(*gssConn).conf || !cli.conn.(*gssConn).conf {
+		t.Fatal("confidentiality not negotiated")
+	}
+
+	// larger than one chunk
+	data := bytes.Repeat([]byte("0123456789"), gssMaxChunk/5)
+	go func() {
+		cli.conn.Write(data)
+		cli.conn.Close()
+	}()
+	got, err := io.ReadAll(svr.conn)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	// level message and chunks are wrapped
+	wraps := cli.conn.(*gssConn).ctx.(*fakeContext).wraps
+	if wraps[true] != 2 || wraps[false] != 1 {
+		t.Fatalf("wraps: %v", wraps)
+	}
+}
+
+func TestGSSAPILevel(t *testing.T) {
+	// client proposal below server minimum is raised
+	svr, cli := gssPair(
+		GSSAPI{Mechanism: fakeMechanism{rounds: 1}, Level: ProtectionConfidentiality},
+		ClientGSSAPI{Mechanism: fakeMechanism{initiator: true, rounds: 1}, Level: ProtectionIntegrity})
+	if svr.err != nil || cli.err != nil {
+		t.Fatalf("server: %v, client: %v", svr.err, cli.err)
+	}
+	if !cli.conn.(*gssConn).conf {
+		t.Fatal("client not raised to confidentiality")
+	}
+
+	// integrity only encapsulation is not encrypted
+	svr, cli = gssPair(
+		GSSAPI{Mechanism: fakeMechanism{rounds: 1}},
+		ClientGSSAPI{Mechanism: fakeMechanism{initiator: true, rounds: 1}, Level: ProtectionIntegrity})
+	if svr.err != nil || cli.err != nil {
+		t.Fatalf("server: %v, client: %v", svr.err, cli.err)
+	}
+	if svr.conn.(*gssConn).conf || cli.conn.(*gssConn).conf {
+		t.Fatal("unexpected confidentiality")
+	}
+}
+
+func TestGSSAPIRejectLevel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	// server answers integrity regardless of proposal
+	go func() {
+		ctx, _ := fakeMechanism{rounds: 1}.NewContext()
+		token, err := readGSS(a, gssMsgAuth)
+		if err != nil {
+			return
+		}
+		output, _, err := ctx.Step(token)
+		if err != nil {
+			return
+		}
+		writeGSS(a, gssMsgAuth, output)
+		_, err = readLevel(a, ctx)
+		if err != nil {
+			return
+		}
+		writeLevel(a, ctx, ProtectionIntegrity)
+		io.Copy(io.Discard, a)
+	}()
+	_, err := ClientGSSAPI{Mechanism: fakeMechanism{initiator: true, rounds: 1}}.Authenticate(b)
+	if err == nil {
+		t.Fatal("accepted protection level below proposal")
+	}
+}
+
+func TestGSSAPINoToken(t *testing.T) {
+	svr, cli := gssPair(
+		GSSAPI{Mechanism: fakeMechanism{rounds: 1}},
+		ClientGSSAPI{Mechanism: fakeMechanism{initiator: true, noToken: true}})
+	if cli.err != errGSSNoToken {
+		t.Fatalf("client: %v", cli.err)
+	}
+	if svr.err != errGSSAbort {
+		t.Fatalf("server: %v", svr.err)
+	}
+}
@@ -0,0 +1,496 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mux frame types, frame header is type(1) stream id(4) length(2)
+const (
+	frameSYN  = 0x00 // open stream
+	frameData = 0x01 // stream data
+	frameFIN  = 0x02 // half-close write side
+	frameRST  = 0x03 // reset stream
+	frameWND  = 0x04 // window update, payload is uint32 increment
+	framePing = 0x05 // keepalive, payload is echoed by pong
+	framePong = 0x06
+
+	muxHeaderSize = 7
+	muxMaxPayload = 16 * 1024
+	muxWindow     = 256 * 1024 // receive window of each stream
+	muxMaxStreams = 1024       // opened streams of each session
+)
+
+var (
+	errMuxClosed = errors.New("mux session closed")
+	errReset     = errors.New("stream reset by peer")
+	errMuxFull   = errors.New("too many mux streams")
+)
+
+// muxSession multiplexed streams over one connection, streams are opened
+// by client with odd ids
+type muxSession struct {
+	active    int64 // keep 64-bit aligned for atomic
+	conn      net.Conn
+	keepAlive time.Duration
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	accept  chan *muxStream
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newMuxSession(conn net.Conn, keepAlive time.Duration, server bool) *muxSession {
+	s := &muxSession{
+		conn:      conn,
+		keepAlive: keepAlive,
+		active:    time.Now().UnixNano(),
+		streams:   make(map[uint32]*muxStream),
+		nextID:    1,
+		die:       make(chan struct{}),
+	}
+	if server {
+		s.accept = make(chan *muxStream, 64)
+	}
+	conn.SetDeadline(time.Time{})
+	go s.recvLoop()
+	go s.keepAliveLoop()
+	return s
+}
+
+// Close close session and all streams
+func (s *muxSession) Close() error {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.conn.Close()
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.notify()
+		}
+		s.streams = nil
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// numStreams count of opened streams, -1 when session closed
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams == nil {
+		return -1
+	}
+	return len(s.streams)
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(payload)))
+	copy(buf[muxHeaderSize:], payload)
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.closed() {
+		return errMuxClosed
+	}
+	_, err := s.conn.Write(buf)
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+// open open stream by client
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.streams == nil {
+		s.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	if len(s.streams) >= muxMaxStreams {
+		s.mu.Unlock()
+		return nil, errMuxFull
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	err := s.writeFrame(frameSYN, id, nil)
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept accept stream opened by client
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, errMuxClosed
+	}
+}
+
+func (s *muxSession) get(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams != nil {
+		delete(s.streams, id)
+	}
+}
+
+func (s *muxSession) recvLoop() {
+	defer s.Close()
+	var hdr [muxHeaderSize]byte
+	for {
+		_, err := io.ReadFull(s.conn, hdr[:])
+		if err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(hdr[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[5:]))
+		_, err = io.ReadFull(s.conn, payload)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&s.active, time.Now().UnixNano())
+		switch hdr[0] {
+		case frameSYN:
+			if s.accept == nil || id%2 == 0 {
+				return
+			}
+			st := newMuxStream(s, id)
+			s.mu.Lock()
+			if s.streams == nil {
+				s.mu.Unlock()
+				return
+			}
+			// duplicated id or too many streams, the frame is dropped
+			if _, ok := s.streams[id]; ok || len(s.streams) >= muxMaxStreams {
+				s.mu.Unlock()
+				go s.writeFrame(frameRST, id, nil)
+				continue
+			}
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			case <-s.die:
+				return
+			}
+		case frameData:
+			if st := s.get(id); st != nil {
+				if !st.push(payload) {
+					// window exceeded
+					s.remove(id)
+					go s.writeFrame(frameRST, id, nil)
+				}
+			} else {
+				// write after close
+				go s.writeFrame(frameRST, id, nil)
+			}
+		case frameFIN:
+			if st := s.get(id); st != nil {
+				st.finish()
+			}
+		case frameRST:
+			if st := s.get(id); st != nil {
+				st.reset()
+				s.remove(id)
+			}
+		case frameWND:
+			if st := s.get(id); st != nil && len(payload) == 4 {
+				st.addCredit(int(binary.BigEndian.Uint32(payload)))
+			}
+		case framePing:
+			go s.writeFrame(framePong, 0, payload)
+		case framePong:
+		default:
+			return
+		}
+	}
+}
+
+// keepAliveLoop send ping and close session when peer is silent for
+// three intervals
+func (s *muxSession) keepAliveLoop() {
+	tk := time.NewTicker(s.keepAlive)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			active := time.Unix(0, atomic.LoadInt64(&s.active))
+			if time.Since(active) > 3*s.keepAlive {
+				s.Close()
+				return
+			}
+			s.writeFrame(framePing, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// muxStream one stream of mux session, implements net.Conn
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	consumed  int // read bytes not acked by window update
+	credit    int // send window
+	finRecv   bool
+	finSent   bool
+	rst       bool
+	closed    bool
+	rdeadline time.Time
+	wdeadline time.Time
+	wake      chan struct{}
+}
+
+func newMuxStream(sess *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		id:     id,
+		sess:   sess,
+		credit: muxWindow,
+		wake:   make(chan struct{}),
+	}
+}
+
+// notify wake up blocked readers and writers after state changed
+func (st *muxStream) notify() {
+	st.mu.Lock()
+	close(st.wake)
+	st.wake = make(chan struct{})
+	st.mu.Unlock()
+}
+
+// push buffer received data, return false when peer sent more than the
+// advertised window, outstanding bytes are buffered and read bytes not acked
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	if st.buf.Len()+st.consumed+len(data) > muxWindow {
+		st.rst = true
+		st.buf.Reset()
+		st.mu.Unlock()
+		st.notify()
+		return false
+	}
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	st.mu.Unlock()
+	st.notify()
+	return true
+}
+
+func (st *muxStream) finish() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+	st.notify()
+}
+
+func (st *muxStream) reset() {
+	st.mu.Lock()
+	st.rst = true
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *muxStream) addCredit(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	st.notify()
+}
+
+// wait block until notified, deadline exceeded or session closed
+func (st *muxStream) wait(wake chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		tm := time.NewTimer(d)
+		defer tm.Stop()
+		timeout = tm.C
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-st.sess.die:
+		return errMuxClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += n
+			var ack int
+			if st.consumed >= muxWindow/2 && !st.finRecv {
+				ack = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if ack > 0 {
+				var inc [4]byte
+				binary.BigEndian.PutUint32(inc[:], uint32(ack))
+				st.sess.writeFrame(frameWND, st.id, inc[:])
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		case st.rst:
+			st.mu.Unlock()
+			return 0, errReset
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		wake, deadline := st.wake, st.rdeadline
+		st.mu.Unlock()
+		if st.sess.closed() {
+			return 0, errMuxClosed
+		}
+		if err := st.wait(wake, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.rst:
+			st.mu.Unlock()
+			return written, errReset
+		}
+		if st.credit <= 0 {
+			wake, deadline := st.wake, st.wdeadline
+			st.mu.Unlock()
+			if err := st.wait(wake, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p)
+		if n > st.credit {
+			n = st.credit
+		}
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		st.credit -= n
+		st.mu.Unlock()
+		err := st.sess.writeFrame(frameData, st.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-close stream, peer reads io.EOF after received data
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.rst || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+	return st.sess.writeFrame(frameFIN, st.id, nil)
+}
+
+// Close close stream, data from peer after close is answered by reset
+func (st *muxStream) Close() error {
+	err := st.CloseWrite()
+	st.mu.Lock()
+	st.closed = true
+	st.buf.Reset()
+	st.mu.Unlock()
+	st.sess.remove(st.id)
+	st.notify()
+	return err
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
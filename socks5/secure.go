@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/lwch/proxy/internal/aead"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	pskSaltSize = 32
+	pskInfo     = "socks5-psk-aes-256-gcm"
+)
+
+var errPin = errors.New("server public key not pinned")
+
+// hkdf info labels of each direction, keys differ even if salts are same
+const (
+	pskClientInfo = pskInfo + " c2s"
+	pskServerInfo = pskInfo + " s2c"
+)
+
+// pskKey derive key of one direction by hkdf-sha256, psk is used as input
+// key material without stretching
+func pskKey(psk, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, psk, salt, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGCM(psk, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := pskKey(psk, salt, info)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newPSKConn AES-256-GCM chunk stream encrypted by pre-shared key, salts
+// received by server are checked by filter to reject replayed connections
+func newPSKConn(c net.Conn, psk []byte, server bool, filter *aead.SaltFilter) net.Conn {
+	rinfo, winfo := pskServerInfo, pskClientInfo
+	if server {
+		rinfo, winfo = pskClientInfo, pskServerInfo
+	}
+	newR := func(salt []byte) (cipher.AEAD, error) {
+		return newGCM(psk, salt, rinfo)
+	}
+	newW := func(salt []byte) (cipher.AEAD, error) {
+		return newGCM(psk, salt, winfo)
+	}
+	return aead.NewConn(c, pskSaltSize, newR, newW, filter)
+}
+
+// clientTLS build tls config of client, the certificate chain is replaced
+// by public key pinning when pins given
+func clientTLS(cfg ClientConf) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(cfg.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	wss := false
+	if len(cfg.WebSocket) > 0 {
+		u, err := url.Parse(cfg.WebSocket)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return nil, fmt.Errorf("unsupported websocket scheme: %s", u.Scheme)
+		}
+		host = u.Hostname()
+		wss = u.Scheme == "wss"
+	}
+	if cfg.TLS == nil && len(cfg.PinSHA256) == 0 && !wss {
+		return nil, nil
+	}
+	var ret *tls.Config
+	if cfg.TLS != nil {
+		ret = cfg.TLS.Clone()
+	} else {
+		ret = &tls.Config{}
+	}
+	if len(ret.ServerName) == 0 {
+		ret.ServerName = host
+	}
+	if len(cfg.PinSHA256) == 0 {
+		return ret, nil
+	}
+	pins := make(map[string]bool, len(cfg.PinSHA256))
+	for _, pin := range cfg.PinSHA256 {
+		data, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(data) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin: %s", pin)
+		}
+		pins[string(data)] = true
+	}
+	ret.InsecureSkipVerify = true
+	ret.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errPin
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if !pins[string(sum[:])] {
+			return errPin
+		}
+		return nil
+	}
+	return ret, nil
+}
+
+// PinSHA256 get base64 sha256 of certificate public key used by ClientConf.PinSHA256
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
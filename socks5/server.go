@@ -2,12 +2,20 @@ package socks5
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/auth"
+	"github.com/lwch/proxy/internal/aead"
+	"github.com/lwch/proxy/outbound"
+	"github.com/lwch/proxy/proxyproto"
+	"github.com/lwch/proxy/sniff"
 )
 
 // ServerHandler server handler
@@ -21,11 +29,40 @@ type ServerHandler interface {
 	Forward(local, remote io.ReadWriteCloser)
 }
 
+// UserHandler optional interface of ServerHandler, when implemented
+// ConnectUser is called instead of Connect with the authenticated user
+type UserHandler interface {
+	ConnectUser(from, user string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
 // ServerConf server config
 type ServerConf struct {
 	ReadTimeout  time.Duration // Default: 1s
 	WriteTimeout time.Duration // Default: 1s
 	Handler      ServerHandler
+	Outbound     outbound.Conf // used by default handler
+	Resolver     *net.Resolver // Default: net.DefaultResolver
+	Sniff        bool          // Default: false, sniff domain by tls SNI or http Host for ip target
+	SniffTimeout time.Duration // Default: 300ms
+	// ProxyProtocol accept proxy protocol header from trusted sources,
+	// Default: nil disabled
+	ProxyProtocol *proxyproto.Conf
+	// TLS serve socks5 over tls, Default: nil disabled
+	TLS *tls.Config
+	// PSK encrypt connections by pre-shared key with AES-256-GCM stream,
+	// applied inside tls when both set, Default: nil disabled. The key is
+	// not stretched, use at least 32 random bytes instead of a password
+	PSK []byte
+	// Authenticators auth methods in preference order, the first one offered
+	// by client is selected, Default: NoAuth or UserPass selected by
+	// ServerHandler.Handshake
+	Authenticators []Authenticator
+	// Guard reject banned clients and users, failures of UserPass are
+	// replied after backoff delay, Default: nil disabled
+	Guard *auth.Guard
+	// Mux accept multiplexed streams negotiated by MethodMux
+	Mux       bool
+	KeepAlive time.Duration // Default: 30s, keepalive interval of mux sessions
 }
 
 // SetDefault check and set default value
@@ -37,14 +74,24 @@ func (cfg *ServerConf) SetDefault() {
 		cfg.WriteTimeout = time.Second
 	}
 	if cfg.Handler == nil {
-		cfg.Handler = defaultServerHandler{}
+		cfg.Handler = defaultServerHandler{out: outbound.New(cfg.Outbound)}
+	}
+	if cfg.SniffTimeout <= 0 {
+		cfg.SniffTimeout = 300 * time.Millisecond
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
 	}
 }
 
 // Server socks5 server
 type Server struct {
 	cfg      ServerConf
-	listener *net.TCPListener
+	filter   *aead.SaltFilter // salts of psk connections
+	listener net.Listener
 
 	// runtime
 	ctx    context.Context
@@ -55,6 +102,9 @@ type Server struct {
 func NewServer(cfg ServerConf) *Server {
 	cfg.SetDefault()
 	svr := &Server{cfg: cfg}
+	if len(cfg.PSK) > 0 {
+		svr.filter = aead.NewSaltFilter(100000)
+	}
 	svr.ctx, svr.cancel = context.WithCancel(context.Background())
 	return svr
 }
@@ -62,7 +112,9 @@ func NewServer(cfg ServerConf) *Server {
 // Shutdown service shutdown
 func (s *Server) Shutdown() {
 	s.cancel()
-	s.listener.Close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
 }
 
 // ListenAndServe listen and serve
@@ -71,57 +123,168 @@ func (s *Server) ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
-	s.listener, err = net.ListenTCP("tcp", resAddr)
+	l, err := net.ListenTCP("tcp", resAddr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve serve connections accepted by l
+func (s *Server) Serve(l net.Listener) error {
+	if s.cfg.ProxyProtocol != nil {
+		l = proxyproto.NewListener(l, *s.cfg.ProxyProtocol)
+	}
+	s.listener = l
 	for {
-		select {
-		case <-s.ctx.Done():
-			return nil
-		default:
-			s.listener.SetDeadline(time.Now().Add(time.Second))
-			conn, err := s.listener.Accept()
-			if err != nil {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
 				continue
 			}
-			go s.handleSocket(conn)
+			return err
 		}
+		go s.handleSocket(conn)
 	}
 }
 
 var errAddr addr.Addr
 
 func (s *Server) handleSocket(c net.Conn) {
+	if s.cfg.TLS != nil {
+		c = tls.Server(c, s.cfg.TLS)
+	}
+	s.serveConn(c)
+}
+
+// serveConn serve socks5 connection of tcp, tls or websocket transport
+func (s *Server) serveConn(c net.Conn) {
+	if len(s.cfg.PSK) > 0 {
+		c = newPSKConn(c, s.cfg.PSK, true, s.filter)
+	}
 	defer c.Close()
+	from := c.RemoteAddr().String()
+	if s.cfg.Guard != nil && s.cfg.Guard.Check(from, "") != nil {
+		s.cfg.Handler.LogError("client banned, addr=%s", from)
+		return
+	}
 	methods, err := waitHandshake(c, s.cfg.ReadTimeout)
 	if err != nil {
 		s.cfg.Handler.LogError("waitHandshake failed" + errInfo(c, err))
 		return
 	}
-	m := s.cfg.Handler.Handshake(methods)
-	err = writeTimeout(c, []byte{VERSION, byte(m)}, s.cfg.WriteTimeout)
+	mux := s.cfg.Mux && hasMethod(methods, MethodMux)
+	if mux {
+		methods = removeMethod(methods, MethodMux)
+	}
+	a := s.authenticator(methods)
+	m := MethodNotSupport
+	if a != nil {
+		m = a.Method()
+	}
+	mux = mux && a != nil
+	if mux {
+		err = writeTimeout(c, []byte{VERSION, byte(MethodMux), byte(m)}, s.cfg.WriteTimeout)
+	} else {
+		err = writeTimeout(c, []byte{VERSION, byte(m)}, s.cfg.WriteTimeout)
+	}
 	if err != nil {
 		s.cfg.Handler.LogError("reply handshake failed, method=%s"+errInfo(c, err), m)
 		return
 	}
-	if m == MethodUserPass {
-		user, pass, err := waitUserPass(c, s.cfg.ReadTimeout)
+	if a == nil {
+		s.cfg.Handler.LogError("no acceptable method, methods=%v, addr=%s", methods, c.RemoteAddr().String())
+		return
+	}
+	timeout := s.cfg.ReadTimeout + s.cfg.WriteTimeout
+	if s.cfg.Guard != nil {
+		timeout += s.cfg.Guard.MaxDelay()
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	a, guarded := s.guard(a)
+	user, conn, err := a.Authenticate(c)
+	if s.cfg.Guard != nil && !guarded {
 		if err != nil {
-			s.cfg.Handler.LogError("waitUserPass failed" + errInfo(c, err))
-			return
-		}
-		ok := s.cfg.Handler.CheckUserPass(user, pass)
-		if ok {
-			err = writeTimeout(c, []byte{0x01, 0x00}, s.cfg.WriteTimeout)
+			s.cfg.Guard.Fail(from, user)
 		} else {
-			err = writeTimeout(c, []byte{0x01, 0x01}, s.cfg.WriteTimeout)
+			s.cfg.Guard.Success(from, user)
+		}
+	}
+	if err != nil {
+		s.cfg.Handler.LogError("authenticate failed, method=%s"+errInfo(c, err), m)
+		return
+	}
+	if conn != c {
+		defer conn.Close()
+		c = conn
+	}
+	if mux {
+		s.serveMux(c, user)
+		return
+	}
+	s.handleRequest(c, user)
+}
+
+// authenticator select authenticator by ServerConf.Authenticators in
+// preference order, or by ServerHandler.Handshake when not set
+func (s *Server) authenticator(methods []Method) Authenticator {
+	if len(s.cfg.Authenticators) > 0 {
+		for _, a := range s.cfg.Authenticators {
+			if hasMethod(methods, a.Method()) {
+				return a
+			}
 		}
+		return nil
+	}
+	switch s.cfg.Handler.Handshake(methods) {
+	case MethodNoAuth:
+		return NoAuth{}
+	case MethodUserPass:
+		return UserPass{Check: s.cfg.Handler.CheckUserPass}
+	}
+	return nil
+}
+
+// guard wrap check of UserPass by ServerConf.Guard, return false when
+// failures should be recorded by caller
+func (s *Server) guard(a Authenticator) (Authenticator, bool) {
+	up, ok := a.(UserPass)
+	if !ok || s.cfg.Guard == nil {
+		return a, false
+	}
+	check := up.CheckFrom
+	if check == nil {
+		fn := up.Check
+		check = func(from, user, pass string) bool {
+			return fn(user, pass)
+		}
+	}
+	return UserPass{CheckFrom: s.cfg.Guard.Wrap(check)}, true
+}
+
+// serveMux serve streams of mux session as socks5 requests
+func (s *Server) serveMux(c net.Conn, user string) {
+	sess := newMuxSession(c, s.cfg.KeepAlive, true)
+	defer sess.Close()
+	for {
+		st, err := sess.Accept()
 		if err != nil {
-			s.cfg.Handler.LogError("reply user/pass failed" + errInfo(c, err))
 			return
 		}
+		go func() {
+			defer st.Close()
+			s.handleRequest(st, user)
+		}()
 	}
+}
+
+func (s *Server) handleRequest(c net.Conn, user string) {
 	cmd, reqAddr, err := waitRequest(c, s.cfg.ReadTimeout)
 	if err != nil {
 		s.cfg.Handler.LogError("waitRequest failed" + errInfo(c, err))
@@ -130,8 +293,16 @@ func (s *Server) handleSocket(c net.Conn) {
 	var remote io.ReadWriteCloser
 	switch cmd {
 	case CmdConnect:
+		if s.cfg.Sniff && reqAddr.Type != addr.Domain {
+			c, remote, err = s.connectSniff(c, user, reqAddr)
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			break
+		}
 		var nextAddr addr.Addr
-		remote, nextAddr, err = s.cfg.Handler.Connect(c.RemoteAddr().String(), reqAddr)
+		remote, nextAddr, err = s.connect(c.RemoteAddr().String(), user, reqAddr)
 		if err != nil {
 			msg := err.Error()
 			t := ReplyUnsupportCmd
@@ -154,6 +325,12 @@ func (s *Server) handleSocket(c net.Conn) {
 	case CmdUDPForward:
 		err = writeTimeout(c, append([]byte{VERSION, byte(ReplyUnsupportCmd), 0x00},
 			errAddr.Bytes()...), s.cfg.WriteTimeout)
+	case CmdResolve, CmdResolvePTR:
+		s.handleResolve(c, cmd, reqAddr)
+		return
+	default:
+		err = writeTimeout(c, append([]byte{VERSION, byte(ReplyUnsupportCmd), 0x00},
+			errAddr.Bytes()...), s.cfg.WriteTimeout)
 	}
 	if err != nil {
 		s.cfg.Handler.LogError("handle failed" + errInfo(c, err))
@@ -162,3 +339,99 @@ func (s *Server) handleSocket(c net.Conn) {
 	c.SetDeadline(time.Time{})
 	s.cfg.Handler.Forward(c, remote)
 }
+
+// connectSniff reply ok before connect, then sniff the domain from the first
+// client bytes and fallback to the original ip when not found
+func (s *Server) connectSniff(c net.Conn, user string, reqAddr addr.Addr) (net.Conn, io.ReadWriteCloser, error) {
+	err := writeTimeout(c, append([]byte{VERSION, byte(ReplyOK), 0x00},
+		errAddr.Bytes()...), s.cfg.WriteTimeout)
+	if err != nil {
+		s.cfg.Handler.LogError("handle failed" + errInfo(c, err))
+		return c, nil, err
+	}
+	host, conn := sniff.Sniff(c, s.cfg.SniffTimeout)
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		s.cfg.Handler.LogDebug("sniffed domain %s for %s", host, reqAddr.String())
+		reqAddr = addr.Addr{Type: addr.Domain, Domain: host, Port: reqAddr.Port}
+	}
+	remote, _, err := s.connect(c.RemoteAddr().String(), user, reqAddr)
+	if err != nil {
+		s.cfg.Handler.LogError("connect %s failed"+errInfo(c, err), reqAddr.String())
+		return conn, nil, err
+	}
+	return conn, remote, nil
+}
+
+func (s *Server) handleResolve(c net.Conn, cmd Cmd, reqAddr addr.Addr) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.ReadTimeout)
+	defer cancel()
+	ret, err := resolve(ctx, s.cfg.Resolver, cmd, reqAddr)
+	if err != nil {
+		s.cfg.Handler.LogError("resolve %s failed"+errInfo(c, err), reqAddr.String())
+		err = writeTimeout(c, append([]byte{VERSION, byte(ReplyHostUnavailable), 0x00},
+			errAddr.Bytes()...), s.cfg.WriteTimeout)
+	} else {
+		err = writeTimeout(c, append([]byte{VERSION, byte(ReplyOK), 0x00},
+			ret.Bytes()...), s.cfg.WriteTimeout)
+	}
+	if err != nil {
+		s.cfg.Handler.LogError("reply resolve failed" + errInfo(c, err))
+	}
+}
+
+func resolve(ctx context.Context, r *net.Resolver, cmd Cmd, reqAddr addr.Addr) (addr.Addr, error) {
+	ret := addr.Addr{Port: reqAddr.Port}
+	if cmd == CmdResolvePTR {
+		if reqAddr.Type != addr.IPV4 && reqAddr.Type != addr.IPV6 {
+			return ret, fmt.Errorf("unsupported address type: %d", reqAddr.Type)
+		}
+		names, err := r.LookupAddr(ctx, reqAddr.IP.String())
+		if err != nil {
+			return ret, err
+		}
+		if len(names) == 0 {
+			return ret, errors.New("no such host")
+		}
+		ret.Type = addr.Domain
+		ret.Domain = strings.TrimSuffix(names[0], ".")
+		return ret, nil
+	}
+	switch reqAddr.Type {
+	case addr.IPV4, addr.IPV6:
+		// nothing to resolve, reply the input address
+		return reqAddr, nil
+	case addr.Domain:
+	default:
+		return ret, fmt.Errorf("unsupported address type: %d", reqAddr.Type)
+	}
+	ips, err := r.LookupIPAddr(ctx, reqAddr.Domain)
+	if err != nil {
+		return ret, err
+	}
+	if len(ips) == 0 {
+		return ret, errors.New("no such host")
+	}
+	// prefer ipv4 like tor does
+	ip := ips[0].IP
+	for _, a := range ips {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ret.Type = addr.IPV4
+		ret.IP = ip4
+	} else {
+		ret.Type = addr.IPV6
+		ret.IP = ip
+	}
+	return ret, nil
+}
+
+func (s *Server) connect(from, user string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	if h, ok := s.cfg.Handler.(UserHandler); ok {
+		return h.ConnectUser(from, user, to)
+	}
+	return s.cfg.Handler.Connect(from, to)
+}
@@ -42,8 +42,7 @@ func waitHandshake(c net.Conn, timeout time.Duration) ([]Method, error) {
 	return ret, nil
 }
 
-func waitUserPass(c net.Conn, timeout time.Duration) (string, string, error) {
-	c.SetReadDeadline(time.Now().Add(timeout))
+func waitUserPass(c net.Conn) (string, string, error) {
 	var hdr [2]byte
 	_, err := io.ReadFull(c, hdr[:])
 	if err != nil {
@@ -58,7 +57,7 @@ func waitUserPass(c net.Conn, timeout time.Duration) (string, string, error) {
 		return "", "", err
 	}
 	var l [1]byte
-	_, err = c.Read(l[:])
+	_, err = io.ReadFull(c, l[:])
 	if err != nil {
 		return "", "", err
 	}
@@ -119,3 +118,22 @@ func waitRequest(c net.Conn, timeout time.Duration) (Cmd, addr.Addr, error) {
 	}
 	return cmd, t, err
 }
+
+func hasMethod(methods []Method, m Method) bool {
+	for _, method := range methods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+func removeMethod(methods []Method, m Method) []Method {
+	ret := methods[:0]
+	for _, method := range methods {
+		if method != m {
+			ret = append(ret, method)
+		}
+	}
+	return ret
+}
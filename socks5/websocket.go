@@ -0,0 +1,338 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://www.rfc-editor.org/rfc/rfc6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var errWSHandshake = errors.New("invalid websocket handshake")
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h http.Header, k, token string) bool {
+	for _, v := range h.Values(k) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn socks5 byte stream carried by websocket binary frames
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // client frames are masked
+
+	rmu       sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	pos       int
+
+	wmu sync.Mutex
+}
+
+func newWSConn(c net.Conn, r *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: c, r: r, client: client}
+}
+
+// readHeader read frame header, control frames are handled inside
+func (c *wsConn) readHeader() error {
+	for {
+		var hdr [2]byte
+		_, err := io.ReadFull(c.r, hdr[:])
+		if err != nil {
+			return err
+		}
+		op := hdr[0] & 0x0f
+		size := uint64(hdr[1] & 0x7f)
+		switch size {
+		case 126:
+			var n [2]byte
+			_, err = io.ReadFull(c.r, n[:])
+			size = uint64(binary.BigEndian.Uint16(n[:]))
+		case 127:
+			var n [8]byte
+			_, err = io.ReadFull(c.r, n[:])
+			size = binary.BigEndian.Uint64(n[:])
+		}
+		if err != nil {
+			return err
+		}
+		c.masked = hdr[1]&0x80 != 0
+		if c.masked {
+			_, err = io.ReadFull(c.r, c.mask[:])
+			if err != nil {
+				return err
+			}
+		}
+		c.pos = 0
+		switch op {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.remaining = size
+			if size == 0 {
+				continue
+			}
+			return nil
+		}
+		if size > 125 {
+			return fmt.Errorf("invalid control frame size: %d", size)
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(c.r, payload)
+		if err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch op {
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		default:
+			return fmt.Errorf("unknown websocket opcode: %d", op)
+		}
+	}
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.pos&3]
+		c.pos++
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.remaining == 0 {
+		err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	start := len(buf)
+	if c.client {
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start = len(buf)
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsOpBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close send close frame and close connection
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return c.Conn.Close()
+}
+
+// ServeHTTP accept websocket upgrade and serve socks5 over binary frames,
+// mount the server on http path to traverse http only networks
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || len(key) == 0 ||
+		!headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.cfg.Handler.LogError("not supported hijacker, addr=%s", req.RemoteAddr)
+		http.Error(w, "not supported hijacker", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.cfg.Handler.LogError("hijack failed; addr=%s, err=%v", req.RemoteAddr, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	err = brw.Flush()
+	if err != nil {
+		s.cfg.Handler.LogError("reply websocket upgrade failed" + errInfo(conn, err))
+		conn.Close()
+		return
+	}
+	s.serveConn(newWSConn(conn, brw.Reader, false))
+}
+
+// dialWebSocket connect websocket url, wss is connected by tls config of
+// client
+func (c *Client) dialWebSocket() (net.Conn, error) {
+	u, err := url.Parse(c.cfg.WebSocket)
+	if err != nil {
+		return nil, fmt.Errorf("parse websocket url: %v", err)
+	}
+	host := u.Host
+	if len(u.Port()) == 0 {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, c.cfg.ReadTimeout+c.cfg.WriteTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(c.cfg.ReadTimeout + c.cfg.WriteTimeout))
+	if u.Scheme == "wss" {
+		tc := tls.Client(conn, c.tls)
+		err = tc.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake: %v", err)
+		}
+		conn = tc
+	}
+	ret, err := c.wsHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake: %v", err)
+	}
+	return ret, nil
+}
+
+func (c *Client) wsHandshake(conn net.Conn, u *url.URL) (net.Conn, error) {
+	var nonce [16]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if len(req.URL.Path) == 0 {
+		req.URL.Path = "/"
+	}
+	for k, v := range c.cfg.WebSocketHeader {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(req.Header.Get("Host")) > 0 {
+		req.Host = req.Header.Get("Host")
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	rep, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	rep.Body.Close()
+	if rep.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("unexpected status: %s", rep.Status)
+	}
+	if rep.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errWSHandshake
+	}
+	return newWSConn(conn, r, true), nil
+}
@@ -0,0 +1,161 @@
+package transparent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/outbound"
+	"github.com/lwch/proxy/sniff"
+)
+
+// ServerHandler server handler
+type ServerHandler interface {
+	LogDebug(format string, a ...interface{})
+	LogError(format string, a ...interface{})
+	LogInfo(format string, a ...interface{})
+	Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+	Forward(local, remote io.ReadWriteCloser)
+}
+
+// UDPHandler optional interface of ServerHandler, ConnectUDP is used
+// for udp sessions and the returned connection must keep message boundaries,
+// when not implemented udp sessions are dialed by ServerConf.Outbound
+type UDPHandler interface {
+	ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error)
+}
+
+// Mode redirect mode
+type Mode int
+
+const (
+	// ModeRedirect iptables REDIRECT target, destination from SO_ORIGINAL_DST
+	ModeRedirect Mode = iota
+	// ModeTProxy iptables TPROXY target, destination from local address
+	ModeTProxy
+)
+
+// ServerConf server config
+type ServerConf struct {
+	Mode         Mode          // Default: ModeRedirect
+	UDPTimeout   time.Duration // Default: 60s
+	Sniff        bool          // Default: false, sniff domain by tls SNI or http Host
+	SniffTimeout time.Duration // Default: 300ms
+	Handler      ServerHandler
+	Outbound     outbound.Conf // used by default handler and udp sessions
+}
+
+// SetDefault check and set default value
+func (cfg *ServerConf) SetDefault() {
+	if cfg.UDPTimeout <= 0 {
+		cfg.UDPTimeout = time.Minute
+	}
+	if cfg.SniffTimeout <= 0 {
+		cfg.SniffTimeout = 300 * time.Millisecond
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = defaultServerHandler{out: outbound.New(cfg.Outbound)}
+	}
+}
+
+// Server transparent proxy server, linux only
+type Server struct {
+	cfg      ServerConf
+	out      *outbound.Dialer
+	listener net.Listener
+	udp      *net.UDPConn
+
+	// runtime
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// NewServer create server
+func NewServer(cfg ServerConf) *Server {
+	cfg.SetDefault()
+	svr := &Server{
+		cfg:      cfg,
+		out:      outbound.New(cfg.Outbound),
+		sessions: make(map[string]*udpSession),
+	}
+	svr.ctx, svr.cancel = context.WithCancel(context.Background())
+	return svr
+}
+
+// Shutdown service shutdown
+func (s *Server) Shutdown() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// ListenAndServe listen and serve tcp connections redirected by iptables/nftables
+func (s *Server) ListenAndServe(addr string) error {
+	lc := net.ListenConfig{Control: listenControl(s.cfg.Mode)}
+	var err error
+	s.listener, err = lc.Listen(s.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+				s.cfg.Handler.LogError("accept failed, err=%v", err)
+				continue
+			}
+		}
+		go s.handleSocket(conn)
+	}
+}
+
+func (s *Server) target(c net.Conn) (addr.Addr, error) {
+	local := c.LocalAddr().(*net.TCPAddr)
+	if s.cfg.Mode == ModeTProxy {
+		return addr.FromIP(local.IP, uint16(local.Port)), nil
+	}
+	ip, port, err := originalDst(c)
+	if err != nil {
+		return addr.Addr{Type: addr.Unknown}, err
+	}
+	if ip.Equal(local.IP) && port == local.Port {
+		return addr.Addr{Type: addr.Unknown}, errNotRedirected
+	}
+	return addr.FromIP(ip, uint16(port)), nil
+}
+
+func (s *Server) handleSocket(c net.Conn) {
+	defer c.Close()
+	to, err := s.target(c)
+	if err != nil {
+		s.cfg.Handler.LogError("get original destination failed" + errInfo(c, err))
+		return
+	}
+	if s.cfg.Sniff {
+		var host string
+		host, c = sniff.Sniff(c, s.cfg.SniffTimeout)
+		if len(host) > 0 && net.ParseIP(host) == nil {
+			s.cfg.Handler.LogDebug("sniffed domain %s for %s", host, to.String())
+			to = addr.Addr{Type: addr.Domain, Domain: host, Port: to.Port}
+		}
+	}
+	remote, _, err := s.cfg.Handler.Connect(c.RemoteAddr().String(), to)
+	if err != nil {
+		s.cfg.Handler.LogError("connect %s failed"+errInfo(c, err), to.String())
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(c, remote)
+}
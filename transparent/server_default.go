@@ -0,0 +1,83 @@
+package transparent
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/outbound"
+)
+
+type defaultServerHandler struct {
+	out *outbound.Dialer
+}
+
+func (h defaultServerHandler) LogDebug(format string, a ...interface{}) {
+	log.Printf("[DEBUG]"+format, a...)
+}
+
+func (h defaultServerHandler) LogInfo(format string, a ...interface{}) {
+	log.Printf("[INFO]"+format, a...)
+}
+
+func (h defaultServerHandler) LogError(format string, a ...interface{}) {
+	log.Printf("[ERROR]"+format, a...)
+}
+
+func (h defaultServerHandler) Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	remote, err := h.out.Dial(from, "", to)
+	if err != nil {
+		return nil, to, err
+	}
+	return remote, to, nil
+}
+
+func (h defaultServerHandler) ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	remote, err := h.out.DialUDP(from, "", to)
+	if err != nil {
+		return nil, to, err
+	}
+	return remote, to, nil
+}
+
+// netCopy copy from io.Copy
+func netCopy(ctx context.Context, cancel context.CancelFunc, dst io.Writer, src io.Reader) (int, error) {
+	defer cancel()
+	const size = 64 * 1024
+	buf := make([]byte, size)
+	var written int
+	for {
+		select {
+		case <-ctx.Done():
+			return written, nil
+		default:
+		}
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += nw
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				return written, er
+			}
+			return written, nil
+		}
+	}
+}
+
+func (h defaultServerHandler) Forward(local, remote io.ReadWriteCloser) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go netCopy(ctx, cancel, local, remote)
+	netCopy(ctx, cancel, remote, local)
+}
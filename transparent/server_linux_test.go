@@ -0,0 +1,236 @@
+package transparent
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+)
+
+// envNetns set in test process re-executed in a new network namespace
+const envNetns = "TRANSPARENT_TEST_NETNS"
+
+// redirected destinations, routed to lo in the namespace
+const (
+	tcpTarget = "198.51.100.10:80"
+	udpTarget = "198.51.100.20:53"
+)
+
+// testHandler record destinations and connect echo servers
+type testHandler struct {
+	defaultServerHandler
+	echo    string
+	tcp     chan addr.Addr
+	udp     chan addr.Addr
+	udpEcho *net.UDPAddr
+}
+
+func (h testHandler) Connect(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	h.tcp <- to
+	conn, err := net.Dial("tcp", h.echo)
+	return conn, to, err
+}
+
+func (h testHandler) ConnectUDP(from string, to addr.Addr) (io.ReadWriteCloser, addr.Addr, error) {
+	h.udp <- to
+	conn, err := net.DialUDP("udp", nil, h.udpEcho)
+	return conn, to, err
+}
+
+// runNetns re-execute test in a new network namespace, returns false
+// when already running in it
+func runNetns(t *testing.T) bool {
+	if os.Getenv(envNetns) == "1" {
+		return false
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("root is required")
+	}
+	for _, bin := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), envNetns+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	out, err := cmd.CombinedOutput()
+	t.Log(string(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func run(t *testing.T, args ...string) {
+	t.Helper()
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v, %s", strings.Join(args, " "), err, out)
+	}
+}
+
+func echoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echoUDP(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func waitAddr(t *testing.T, ch chan addr.Addr, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got.String() != want {
+			t.Fatalf("destination: %s, want %s", got.String(), want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+}
+
+func echo(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != data {
+		t.Fatalf("echo: %q, want %q", buf, data)
+	}
+}
+
+func TestTransparent(t *testing.T) {
+	if runNetns(t) {
+		return
+	}
+	const tcpPort, udpPort = "12345", "12346"
+	run(t, "ip", "link", "set", "lo", "up")
+	run(t, "ip", "route", "add", "198.51.100.0/24", "dev", "lo")
+	// REDIRECT locally generated tcp
+	run(t, "iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "198.51.100.10",
+		"-j", "REDIRECT", "--to-ports", tcpPort)
+	// TPROXY only works in PREROUTING, marked udp is routed back by lo
+	run(t, "ip", "rule", "add", "fwmark", "1", "lookup", "100")
+	run(t, "ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100")
+	run(t, "iptables", "-t", "mangle", "-A", "OUTPUT", "-p", "udp", "-d", "198.51.100.20",
+		"-j", "MARK", "--set-mark", "1")
+	run(t, "iptables", "-t", "mangle", "-A", "PREROUTING", "-p", "udp", "-d", "198.51.100.20",
+		"-j", "TPROXY", "--on-ip", "127.0.0.1", "--on-port", udpPort, "--tproxy-mark", "1")
+
+	t.Run("originalDst", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:"+tcpPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		go func() {
+			conn, err := net.DialTimeout("tcp", tcpTarget, 5*time.Second)
+			if err == nil {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}
+		}()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ip, port, err := originalDst(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := net.JoinHostPort(ip.String(), strconv.Itoa(port)); got != tcpTarget {
+			t.Fatalf("original destination: %s, want %s", got, tcpTarget)
+		}
+	})
+
+	h := testHandler{
+		echo:    echoTCP(t),
+		tcp:     make(chan addr.Addr, 1),
+		udp:     make(chan addr.Addr, 1),
+		udpEcho: echoUDP(t),
+	}
+	svr := NewServer(ServerConf{Handler: h})
+	defer svr.Shutdown()
+	go svr.ListenAndServe("127.0.0.1:" + tcpPort)
+	go svr.ListenAndServeUDP("127.0.0.1:" + udpPort)
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", tcpTarget, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		waitAddr(t, h.tcp, tcpTarget)
+		echo(t, conn, "hello tcp")
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		// connected socket only accepts replies from original destination
+		conn, err := net.Dial("udp", udpTarget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello udp")); err != nil {
+			t.Fatal(err)
+		}
+		waitAddr(t, h.udp, udpTarget)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hello udp" {
+			t.Fatalf("echo: %q", buf[:n])
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package transparent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// definded by linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h and linux/in6.h
+const (
+	soOriginalDst       = 80
+	ip6tSoOriginalDst   = 80
+	ipv6RecvOrigDstAddr = 74
+	ipv6Transparent     = 75
+)
+
+func setTransparent(fd int) error {
+	err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	if err != nil {
+		return err
+	}
+	// ignore error on ipv4 only socket
+	syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+	return nil
+}
+
+func rawControl(c syscall.RawConn, fn func(fd int) error) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func listenControl(mode Mode) func(network, address string, c syscall.RawConn) error {
+	if mode != ModeTProxy {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return rawControl(c, setTransparent)
+	}
+}
+
+func udpListenControl(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd int) error {
+		err := setTransparent(fd)
+		if err != nil {
+			return err
+		}
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		if err != nil {
+			return err
+		}
+		syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		return nil
+	})
+}
+
+func replyControl(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd int) error {
+		err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err != nil {
+			return err
+		}
+		return setTransparent(fd)
+	})
+}
+
+// dialReply create udp socket bound to original destination for reply client
+func dialReply(from, to *net.UDPAddr) (net.Conn, error) {
+	dialer := net.Dialer{
+		LocalAddr: from,
+		Control:   replyControl,
+	}
+	return dialer.Dial("udp", to.String())
+}
+
+func ntohs(port uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(&port))
+	return int(p[0])<<8 | int(p[1])
+}
+
+// originalDst get destination before REDIRECT by SO_ORIGINAL_DST
+func originalDst(c net.Conn) (net.IP, int, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, 0, errors.New("not supported syscall conn")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	var ip net.IP
+	var port int
+	isV4 := c.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = rawControl(raw, func(fd int) error {
+		// the result buffers of GetsockoptIPv6Mreq and GetsockoptIPv6MTUInfo
+		// are large enough for sockaddr_in and sockaddr_in6
+		if isV4 {
+			mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				return err
+			}
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+			ip = net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
+			port = ntohs(sa.Port)
+			return nil
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			return err
+		}
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		port = ntohs(info.Addr.Port)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, port, nil
+}
+
+// parseOrigDst parse destination before TPROXY from IP_ORIGDSTADDR control message
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR:
+			var sa syscall.RawSockaddrInet4
+			if len(msg.Data) < int(unsafe.Sizeof(sa)) {
+				return nil, errors.New("invalid IP_ORIGDSTADDR")
+			}
+			sa = *(*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{
+				IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+				Port: ntohs(sa.Port),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr:
+			var sa syscall.RawSockaddrInet6
+			if len(msg.Data) < int(unsafe.Sizeof(sa)) {
+				return nil, errors.New("invalid IPV6_ORIGDSTADDR")
+			}
+			sa = *(*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, sa.Addr[:])
+			return &net.UDPAddr{IP: ip, Port: ntohs(sa.Port)}, nil
+		}
+	}
+	return nil, errors.New("original destination not found")
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errNotSupported = errors.New("transparent proxy only supported on linux")
+
+func listenControl(mode Mode) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errNotSupported
+	}
+}
+
+func udpListenControl(network, address string, c syscall.RawConn) error {
+	return errNotSupported
+}
+
+func dialReply(from, to *net.UDPAddr) (net.Conn, error) {
+	return nil, errNotSupported
+}
+
+func originalDst(c net.Conn) (net.IP, int, error) {
+	return nil, 0, errNotSupported
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,124 @@
+package transparent
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/lwch/proxy/addr"
+	"github.com/lwch/proxy/internal/udpsession"
+)
+
+// ListenAndServeUDP listen and serve udp datagrams redirected by TPROXY target
+func (s *Server) ListenAndServeUDP(addr string) error {
+	lc := net.ListenConfig{Control: udpListenControl}
+	pc, err := lc.ListenPacket(s.ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	s.udp = pc.(*net.UDPConn)
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, from, err := s.udp.ReadMsgUDP(buf, oob)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+				s.cfg.Handler.LogError("read udp failed, err=%v", err)
+				continue
+			}
+		}
+		to, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			s.cfg.Handler.LogError("get udp original destination failed; addr=%s, err=%v",
+				from.String(), err)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		key := from.String() + "-" + to.String()
+		s.mu.Lock()
+		sess, ok := s.sessions[key]
+		if !ok {
+			sess = newUDPSession(from, to, s.cfg.UDPTimeout)
+			s.sessions[key] = sess
+			go s.handleSession(key, sess)
+		}
+		s.mu.Unlock()
+		sess.Push(data)
+	}
+}
+
+func (s *Server) connectUDP(from string, to addr.Addr) (io.ReadWriteCloser, error) {
+	if h, ok := s.cfg.Handler.(UDPHandler); ok {
+		remote, _, err := h.ConnectUDP(from, to)
+		return remote, err
+	}
+	return s.out.DialUDP(from, "", to)
+}
+
+func (s *Server) handleSession(key string, sess *udpSession) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}()
+	defer sess.Close()
+	reply, err := dialReply(sess.to, sess.from)
+	if err != nil {
+		s.cfg.Handler.LogError("create udp reply socket for %s failed; addr=%s, err=%v",
+			sess.to.String(), sess.from.String(), err)
+		return
+	}
+	sess.reply = reply
+	// the kernel may deliver datagrams to the connected reply socket
+	go sess.readReply()
+	to := addr.FromIP(sess.to.IP, uint16(sess.to.Port))
+	remote, err := s.connectUDP(sess.from.String(), to)
+	if err != nil {
+		s.cfg.Handler.LogError("connect udp %s failed; addr=%s, err=%v",
+			to.String(), sess.from.String(), err)
+		return
+	}
+	defer remote.Close()
+	s.cfg.Handler.Forward(sess, remote)
+}
+
+// udpSession datagrams from client to one original destination
+type udpSession struct {
+	*udpsession.Session
+	from, to *net.UDPAddr
+	reply    net.Conn // bound to original destination, replies are sent by it
+}
+
+func newUDPSession(from, to *net.UDPAddr, timeout time.Duration) *udpSession {
+	sess := &udpSession{from: from, to: to}
+	sess.Session = udpsession.New(timeout, func(p []byte) (int, error) {
+		return sess.reply.Write(p)
+	})
+	return sess
+}
+
+func (s *udpSession) readReply() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.reply.Read(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		s.Push(data)
+	}
+}
+
+// Close close session and reply socket
+func (s *udpSession) Close() error {
+	s.Session.Close()
+	if s.reply != nil {
+		s.reply.Close()
+	}
+	return nil
+}
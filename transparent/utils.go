@@ -0,0 +1,13 @@
+package transparent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errNotRedirected = errors.New("connection is not redirected")
+
+func errInfo(c net.Conn, err error) string {
+	return fmt.Sprintf("; addr=%s, err=%v", c.RemoteAddr().String(), err)
+}